@@ -1,43 +1,80 @@
 package main
 
 import (
-	"bufio"
-	"encoding/binary"
+	"bytes"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
-	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/zakariaCHOUKRI/ZikoDB/zikodb"
 )
 
 type KeyValueStoreAPI struct {
-	memtable *Memtable
-	wal      *WAL
+	db        *zikodb.DB
+	snapshots *snapshotRegistry
 }
 
-func NewKeyValueStoreAPI(memtable *Memtable, wal *WAL) *KeyValueStoreAPI {
+func NewKeyValueStoreAPI(db *zikodb.DB) *KeyValueStoreAPI {
 	return &KeyValueStoreAPI{
-		memtable: memtable,
-		wal:      wal,
+		db:        db,
+		snapshots: newSnapshotRegistry(),
+	}
+}
+
+// Reads are made on the database or on one of its snapshots
+type reader interface {
+	Get(key []byte) ([]byte, error)
+	NewIterator(start, end []byte) (*zikodb.Iterator, error)
+	NewPrefixIterator(prefix []byte) (*zikodb.Iterator, error)
+}
+
+// The snapshot named by the snapshot parameter of the request, or the
+// Database itself without one. The response is already written when it
+// Returns false
+func (api *KeyValueStoreAPI) reader(w http.ResponseWriter, r *http.Request) (reader, bool) {
+	id := r.URL.Query().Get("snapshot")
+	if id == "" {
+		return api.db, true
+	}
+	snapshot, ok := api.snapshots.get(id)
+	if !ok {
+		http.Error(w, "Snapshot not found", http.StatusNotFound)
+		return nil, false
 	}
+	return snapshot, true
 }
 
+// Get the value of key, as of the snapshot given by snapshot if any
 func (api *KeyValueStoreAPI) GetHandler(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Query().Get("key")
 
-	if api.memtable.deletedKeys[key] != nil {
-		w.Write([]byte(fmt.Sprintf("Key not found\n")))
+	db, ok := api.reader(w, r)
+	if !ok {
 		return
 	}
 
-	value := api.memtable.Get(key)
-	if value != nil {
+	value, err := db.Get([]byte(key))
+	switch {
+	case errors.Is(err, zikodb.ErrSnapshotReleased):
+		http.Error(w, "Snapshot not found", http.StatusNotFound)
+	case errors.Is(err, zikodb.ErrDeleted):
+		w.Write([]byte("Key is deleted\n"))
+	case errors.Is(err, zikodb.ErrNotFound):
+		w.Write([]byte("Key not found\n"))
+	case errors.Is(err, zikodb.ErrCorruptSST):
+		log.Printf("Error reading SST files: %v\n", err)
+		http.Error(w, "Corrupt SST file", http.StatusInternalServerError)
+	case err != nil:
+		log.Printf("Error reading SST files: %v\n", err)
+		w.Write([]byte("Error reading SST files\n"))
+	default:
 		w.Write([]byte(fmt.Sprintf("Value: %s\n", value)))
-		return
 	}
-
-	api.searchForKeyInSSTFiles(key, w)
 }
 
 func (api *KeyValueStoreAPI) SetHandler(w http.ResponseWriter, r *http.Request) {
@@ -60,43 +97,26 @@ func (api *KeyValueStoreAPI) SetHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	walEntry := &WALEntry{
-		Action: 'S',
-		Key:    []byte(fmt.Sprintf("%v", key)),
-		Value:  []byte(fmt.Sprintf("%v", value)),
-	}
-	if err := api.wal.Write(walEntry); err != nil {
+	// Update memtable through the wal, this also replaces any tombstone for the key.
+	// Put returns once the write is as durable as the sync mode asks, only then is it acknowledged
+	if err := api.db.Put([]byte(key), []byte(value)); err != nil {
 		log.Printf("Error writing to WAL: %v\n", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
-	// Update memtable
-	api.memtable.Set(key, []byte(value))
-
-	// Remove from deleted table if exists
-	if api.memtable.IsDeleted(key) {
-		delete(api.memtable.deletedKeys, key)
-	}
-
 	w.Write([]byte("OK\n"))
 }
 
 func (api *KeyValueStoreAPI) DeleteHandler(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Query().Get("key")
 
-	walEntry := &WALEntry{
-		Action: 'D',
-		Key:    []byte(fmt.Sprintf("%s", key)),
-		Value:  []byte(fmt.Sprintf("%s", "")),
+	if err := api.db.Delete([]byte(key)); err != nil {
+		log.Printf("Error writing to WAL: %v\n", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
 	}
 
-	api.wal.Write(walEntry)
-
-	// value :=
-	api.memtable.Del(key)
-	api.memtable.MarkDeleted(key)
-
 	// if value == nil {
 	// 	w.Write([]byte("Key not found\n"))
 	// 	return
@@ -107,206 +127,309 @@ func (api *KeyValueStoreAPI) DeleteHandler(w http.ResponseWriter, r *http.Reques
 	w.Write([]byte(fmt.Sprintf("Deletion Done.")))
 }
 
-func StartAPI(memtable *Memtable, wal *WAL) {
-	api := NewKeyValueStoreAPI(memtable, wal)
+// Apply a json array of operations atomically, each one either
+// {"op": "set", "key": ..., "value": ...} or {"op": "del", "key": ...}.
+// Nothing is written when one of them is invalid
+func (api *KeyValueStoreAPI) BatchHandler(w http.ResponseWriter, r *http.Request) {
+	var operations []map[string]string
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&operations); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
 
-	http.HandleFunc("/get", api.GetHandler)
-	http.HandleFunc("/set", api.SetHandler)
-	http.HandleFunc("/del", api.DeleteHandler)
+	var batch zikodb.WriteBatch
+	for i, operation := range operations {
+		key, exists := operation["key"]
+		if !exists {
+			http.Error(w, fmt.Sprintf("Key not provided in operation %d", i), http.StatusBadRequest)
+			return
+		}
+
+		switch operation["op"] {
+		case "set":
+			value, exists := operation["value"]
+			if !exists {
+				http.Error(w, fmt.Sprintf("Value not provided in operation %d", i), http.StatusBadRequest)
+				return
+			}
+			batch.Put([]byte(key), []byte(value))
+		case "del":
+			batch.Delete([]byte(key))
+		default:
+			http.Error(w, fmt.Sprintf("Unknown op %q in operation %d", operation["op"], i), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := api.db.Write(&batch); err != nil {
+		log.Printf("Error writing to WAL: %v\n", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write([]byte("OK\n"))
+}
 
-	port := 8080
-	fmt.Printf("Listening on port %d...\n", port)
-	http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+// Number of results written between two flushes of a scan response
+const scanFlushInterval = 100
+
+// One result of a scan, written as a line of json
+type scanResult struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
 }
 
-type SSTEntry struct {
-	OpType byte
-	Key    string
-	Value  string
+// One result of a key listing
+type keyResult struct {
+	Key string `json:"key"`
 }
 
-// Search for given key in sst files, my sst files are designed
-// In a way that makes all set entries come before all del entries.
-// So we basically iterate backwards through the sst files and
-// Forward inside each sst file. We read entries following our
-// Design, and if a key matches in a set entry, we store its value.
-// If we encounter a del entry, we immediately return that there is
-// No such key. This is guaranteed due to the way I implemented the
-// Del functionality. Otherwise, if the key is not found in this file
-// We look in the next one until we either find something (del or set)
-// Or until we finish looking through all the files (key never existed)
-func (api *KeyValueStoreAPI) searchForKeyInSSTFiles(key string, w http.ResponseWriter) {
-	sstFiles, err := os.ReadDir("data/sst/")
+// Last line of a scan stopped by its limit, passing the cursor back
+// Resumes the scan right after the last key returned
+type scanCursor struct {
+	Cursor string `json:"cursor"`
+}
+
+// The cursor is the last key returned and the direction of the scan, it
+// Holds no server state so it stays valid while writes go on
+func encodeCursor(key []byte, reverse bool) string {
+	direction := byte('f')
+	if reverse {
+		direction = 'r'
+	}
+	return base64.RawURLEncoding.EncodeToString(append([]byte{direction}, key...))
+}
+
+func decodeCursor(cursor string) ([]byte, bool, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
 	if err != nil {
-		w.Write([]byte("Error reading SST files\n"))
-		return
+		return nil, false, err
 	}
+	if len(data) == 0 || data[0] != 'f' && data[0] != 'r' {
+		return nil, false, errors.New("invalid cursor")
+	}
+	return data[1:], data[0] == 'r', nil
+}
+
+// Stream the live keys in [start, end) or starting with prefix in key
+// Order with their values, one json object per line. An empty start or
+// End leaves that side of the range open and a limit of 0 returns every
+// Key of the range. With reverse=true the keys come in descending order.
+// A scan stopped by its limit ends with a cursor line, the same request
+// With cursor set to it returns the next page. With snapshot set to the
+// Id of a snapshot the keys are read as of the snapshot, which keeps the
+// Pages of a scan consistent with each other
+func (api *KeyValueStoreAPI) ScanHandler(w http.ResponseWriter, r *http.Request) {
+	api.scan(w, r, func(key, value []byte) any {
+		return scanResult{Key: string(key), Value: string(value)}
+	})
+}
 
-	for i := len(sstFiles) - 1; i >= 0; i-- {
-		found := false
-		var value string
+// Stream the live keys starting with prefix in key order, without their
+// Values. It takes the same parameters as /scan
+func (api *KeyValueStoreAPI) KeysHandler(w http.ResponseWriter, r *http.Request) {
+	api.scan(w, r, func(key, value []byte) any {
+		return keyResult{Key: string(key)}
+	})
+}
 
-		sstFilePath := filepath.Join("data/sst/", sstFiles[i].Name())
-		sstFile, err := os.Open(sstFilePath)
-		if err != nil {
-			log.Printf("Error opening SST file %s: %v\n", sstFilePath, err)
-			continue
-		}
-		// fmt.Println("sstFilePath:", sstFilePath)
+func (api *KeyValueStoreAPI) scan(w http.ResponseWriter, r *http.Request, result func(key, value []byte) any) {
+	query := r.URL.Query()
 
-		reader := bufio.NewReader(sstFile)
+	var start, end, prefix []byte
+	if value := query.Get("start"); value != "" {
+		start = []byte(value)
+	}
+	if value := query.Get("end"); value != "" {
+		end = []byte(value)
+	}
+	if value := query.Get("prefix"); value != "" {
+		prefix = []byte(value)
+	}
+	if prefix != nil && (start != nil || end != nil) {
+		http.Error(w, "A prefix cannot be combined with start and end", http.StatusBadRequest)
+		return
+	}
 
-		var magicNumber uint32
-		if err := binary.Read(reader, binary.BigEndian, &magicNumber); err != nil {
-			log.Printf("Error reading magic number from SST file %s: %v\n", sstFilePath, err)
-			continue
+	limit := 0
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
 		}
-		// fmt.Println("magicNumber:", magicNumber)
+	}
 
-		if magicNumber != 0x23102003 {
-			log.Printf("Invalid SST file format in %s\n", sstFilePath)
-			continue
+	reverse := false
+	if value := query.Get("reverse"); value != "" {
+		var err error
+		if reverse, err = strconv.ParseBool(value); err != nil {
+			http.Error(w, "Invalid reverse", http.StatusBadRequest)
+			return
 		}
+	}
 
-		var entryCount, smallestKeyLen, largestKeyLen uint32
-		if err := binary.Read(reader, binary.BigEndian, &entryCount); err != nil {
-			log.Printf("Error reading entry count from SST file %s: %v\n", sstFilePath, err)
-			continue
+	var after []byte
+	if value := query.Get("cursor"); value != "" {
+		key, cursorReverse, err := decodeCursor(value)
+		if err != nil || cursorReverse != reverse {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
 		}
-		// fmt.Println("entryCount:", entryCount)
+		after = key
+	}
 
-		if err := binary.Read(reader, binary.BigEndian, &smallestKeyLen); err != nil {
-			log.Printf("Error reading smallest key length from SST file %s: %v\n", sstFilePath, err)
-			continue
-		}
-		// fmt.Println("smallestKeyLen:", smallestKeyLen)
+	db, ok := api.reader(w, r)
+	if !ok {
+		return
+	}
 
-		smallestKeyBytes := make([]byte, smallestKeyLen)
-		// if _, err := reader.Read(smallestKeyBytes); err != nil {
-		if err := binary.Read(reader, binary.BigEndian, smallestKeyBytes); err != nil {
-			log.Printf("Error reading smallest key from SST file %s: %v\n", sstFilePath, err)
-			continue
+	var it *zikodb.Iterator
+	var err error
+	if prefix != nil {
+		it, err = db.NewPrefixIterator(prefix)
+	} else {
+		it, err = db.NewIterator(start, end)
+	}
+	if errors.Is(err, zikodb.ErrSnapshotReleased) {
+		http.Error(w, "Snapshot not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error scanning: %v\n", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer it.Close()
+
+	// Resume after the key of the cursor, which may have been deleted
+	// Since. Keys written since are returned when they come after it
+	advance := it.Next
+	switch {
+	case reverse && after != nil:
+		it.SeekForPrev(after)
+		if it.Valid() && bytes.Equal(it.Key(), after) {
+			it.Prev()
+		}
+	case reverse:
+		it.SeekToLast()
+	case after != nil:
+		it.Seek(after)
+		if it.Valid() && bytes.Equal(it.Key(), after) {
+			it.Next()
 		}
+	}
+	if reverse {
+		advance = it.Prev
+	}
 
-		// smallestKey := string(smallestKeyBytes)
-		// fmt.Println("smallestKey:", smallestKey)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	controller := http.NewResponseController(w)
 
-		if err := binary.Read(reader, binary.BigEndian, &largestKeyLen); err != nil {
-			log.Printf("Error reading largest key length from SST file %s: %v\n", sstFilePath, err)
-			continue
+	count := 0
+	var last []byte
+	for ; it.Valid(); advance() {
+		if limit > 0 && count == limit {
+			encoder.Encode(scanCursor{Cursor: encodeCursor(last, reverse)})
+			break
 		}
-		// fmt.Println("largestKeyLen:", largestKeyLen)
+		if err := encoder.Encode(result(it.Key(), it.Value())); err != nil {
+			// The client went away
+			return
+		}
+		count++
+		last = it.Key()
+		if count%scanFlushInterval == 0 {
+			controller.Flush()
+		}
+	}
 
-		largestKeyBytes := make([]byte, largestKeyLen)
-		// if _, err := reader.Read(largestKeyBytes); err != nil {
-		if err := binary.Read(reader, binary.BigEndian, largestKeyBytes); err != nil {
-			log.Printf("Error reading largest key from SST file %s: %v\n", sstFilePath, err)
-			continue
+	// The status is already sent once results were written, the
+	// Response then just ends early
+	if err := it.Err(); err != nil {
+		log.Printf("Error scanning SST files: %v\n", err)
+		if count == 0 {
+			http.Error(w, "Error reading SST files", http.StatusInternalServerError)
 		}
+	}
+}
 
-		// largestKey := string(largestKeyBytes)
-		// fmt.Println("largestKey:", largestKey)
+// Returned when a snapshot is created
+type snapshotInfo struct {
+	ID       string `json:"id"`
+	Sequence uint64 `json:"sequence"`
+	TTL      string `json:"ttl"`
+}
 
-		var version uint16
-		if err := binary.Read(reader, binary.BigEndian, &version); err != nil {
-			log.Printf("Error reading key length from SST file %s: %v\n", sstFilePath, err)
-			break
-		}
-		// fmt.Println("version:", version)
-
-		// Check if the target key falls within the range defined by the smallest and largest keys.
-		if len(key) >= int(smallestKeyLen) && len(key) <= int(largestKeyLen) {
-			// Perform a linear search within the SST file for the target key.
-			for j := 0; j < int(entryCount); j++ {
-				var opType byte
-				if err := binary.Read(reader, binary.BigEndian, &opType); err != nil {
-					log.Printf("Error reading key length from SST file %s: %v\n", sstFilePath, err)
-					break
-				}
-				// fmt.Println("opType:", opType)
-
-				if opType == 'S' {
-					var keyLen, valueLen uint32
-					if err := binary.Read(reader, binary.BigEndian, &keyLen); err != nil {
-						log.Printf("Error reading key length from SST file %s: %v\n", sstFilePath, err)
-						break
-					}
-					// fmt.Println("keyLen:", keyLen)
-
-					keyBytes := make([]byte, keyLen)
-					// if _, err := reader.Read(keyBytes); err != nil {
-					if err := binary.Read(reader, binary.BigEndian, keyBytes); err != nil {
-						log.Printf("Error reading key from SST file %s: %v\n", sstFilePath, err)
-						break
-					}
-
-					currentKey := string(keyBytes)
-					// fmt.Println("currentKey:", currentKey)
-
-					if err := binary.Read(reader, binary.BigEndian, &valueLen); err != nil {
-						log.Printf("Error reading value length from SST file %s: %v\n", sstFilePath, err)
-						break
-					}
-					// fmt.Println("valueLen:", valueLen)
-
-					if currentKey == key {
-						found = true
-						valueBytes := make([]byte, valueLen)
-						// if _, err := reader.Read(valueBytes); err != nil {
-						if err := binary.Read(reader, binary.BigEndian, valueBytes); err != nil {
-							log.Printf("Error reading value from SST file %s: %v\n", sstFilePath, err)
-							break
-						}
-
-						value = string(valueBytes)
-						fmt.Println("value:", value)
-					} else {
-						notValueBytes := make([]byte, valueLen)
-						// if _, err := reader.Read(notValueBytes); err != nil {
-						if err := binary.Read(reader, binary.BigEndian, notValueBytes); err != nil {
-							log.Printf("Error reading value from SST file %s: %v\n", sstFilePath, err)
-							break
-						}
-
-						// note to self:
-						// comment the 2 lines below when you finish testing
-						// notValue := string(notValueBytes)
-						// fmt.Println("notValue:", notValue)
-					}
-				} else if opType == 'D' {
-					var keyLen uint32
-					if err := binary.Read(reader, binary.BigEndian, &keyLen); err != nil {
-						log.Printf("Error reading key length from SST file %s: %v\n", sstFilePath, err)
-						break
-					}
-					// fmt.Println("keyLen:", keyLen)
-
-					keyBytes := make([]byte, keyLen)
-					// if _, err := reader.Read(keyBytes); err != nil {
-					if err := binary.Read(reader, binary.BigEndian, keyBytes); err != nil {
-						log.Printf("Error reading key from SST file %s: %v\n", sstFilePath, err)
-						break
-					}
-
-					currentKey := string(keyBytes)
-					// fmt.Println("currentKey:", currentKey)
-
-					if currentKey == key {
-						w.Write([]byte("Key is deleted\n"))
-						return
-					}
-				}
+// POST creates a snapshot and returns its id, to pass as the snapshot
+// Parameter of /get, /scan and /keys. The snapshot is released after
+// Going unused for ttl, a duration like 30s, or one minute by default.
+// DELETE with id releases it right away
+func (api *KeyValueStoreAPI) SnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	switch r.Method {
+	case http.MethodPost:
+		ttl := defaultSnapshotTTL
+		if value := query.Get("ttl"); value != "" {
+			var err error
+			if ttl, err = time.ParseDuration(value); err != nil || ttl <= 0 || ttl > maxSnapshotTTL {
+				http.Error(w, "Invalid ttl", http.StatusBadRequest)
+				return
 			}
 		}
 
-		sstFile.Close()
+		snapshot, err := api.db.NewSnapshot()
+		if err != nil {
+			log.Printf("Error creating snapshot: %v\n", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		id, err := api.snapshots.add(snapshot, ttl)
+		if err != nil {
+			snapshot.Release()
+			log.Printf("Error creating snapshot: %v\n", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
 
-		if found {
-			w.Write([]byte(fmt.Sprintf("Value: %s\n", value)))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(snapshotInfo{ID: id, Sequence: snapshot.Sequence(), TTL: ttl.String()})
+	case http.MethodDelete:
+		if !api.snapshots.release(query.Get("id")) {
+			http.Error(w, "Snapshot not found", http.StatusNotFound)
 			return
 		}
+		w.Write([]byte("OK\n"))
+	default:
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
+}
+
+func (api *KeyValueStoreAPI) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := api.db.Stats()
 
-	// If the key is still not found after searching all SST files, respond accordingly
-	w.Write([]byte("Key not found\n"))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// Register the endpoints and serve them on port, this only
+// Returns when the server stops
+func StartAPI(db *zikodb.DB, address string) error {
+	api := NewKeyValueStoreAPI(db)
+
+	http.HandleFunc("/get", api.GetHandler)
+	http.HandleFunc("/set", api.SetHandler)
+	http.HandleFunc("/del", api.DeleteHandler)
+	http.HandleFunc("/batch", api.BatchHandler)
+	http.HandleFunc("/scan", api.ScanHandler)
+	http.HandleFunc("/keys", api.KeysHandler)
+	http.HandleFunc("/snapshot", api.SnapshotHandler)
+	http.HandleFunc("/stats", api.StatsHandler)
+
+	fmt.Printf("Listening on %s...\n", address)
+	return http.ListenAndServe(address, nil)
 }
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zakariaCHOUKRI/ZikoDB/zikodb"
+)
+
+// Run a handler and return the body of its response
+func serve(handler http.HandlerFunc, r *http.Request) string {
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w.Body.String()
+}
+
+// Every worker owns a set of keys and checks that it reads back its own
+// Writes while the memtable gets frozen, flushed and compacted under it.
+// The small memtable makes flushes and compactions happen all along
+func TestConcurrentRequests(t *testing.T) {
+	dir := t.TempDir()
+	options := &zikodb.Options{MemtableEntries: 40, FlushInterval: 5 * time.Millisecond}
+	db, err := zikodb.Open(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := NewKeyValueStoreAPI(db)
+
+	get := func(key string) string {
+		return serve(api.GetHandler, httptest.NewRequest("GET", "/get?key="+key, nil))
+	}
+
+	const workers, keys, rounds = 8, 50, 5
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for round := 0; round < rounds; round++ {
+				for k := 0; k < keys; k++ {
+					key := fmt.Sprintf("w%d-k%d", worker, k)
+					value := fmt.Sprintf("%d", round)
+
+					body := strings.NewReader(fmt.Sprintf(`{"key": %q, "value": %q}`, key, value))
+					serve(api.SetHandler, httptest.NewRequest("POST", "/set", body))
+					if got := get(key); got != "Value: "+value+"\n" {
+						t.Errorf("Get(%s) after Set returned %q", key, got)
+						return
+					}
+
+					if k%3 == round%3 {
+						serve(api.DeleteHandler, httptest.NewRequest("DELETE", "/del?key="+key, nil))
+						if got := get(key); strings.HasPrefix(got, "Value") {
+							t.Errorf("Get(%s) after Del returned %q", key, got)
+							return
+						}
+					}
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	// Everything must also be found after a restart
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = zikodb.Open(dir, options); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	api = NewKeyValueStoreAPI(db)
+
+	for worker := 0; worker < workers; worker++ {
+		for k := 0; k < keys; k++ {
+			key := fmt.Sprintf("w%d-k%d", worker, k)
+			expected := fmt.Sprintf("Value: %d\n", rounds-1)
+			if k%3 == (rounds-1)%3 {
+				expected = ""
+			}
+			if got := get(key); expected != "" && got != expected || expected == "" && strings.HasPrefix(got, "Value") {
+				t.Errorf("Get(%s) returned %q at the end, expected %q", key, got, expected)
+			}
+		}
+	}
+}
+
+func TestScanHandler(t *testing.T) {
+	db, err := zikodb.Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	api := NewKeyValueStoreAPI(db)
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		db.Put([]byte(key), []byte(key+"1"))
+	}
+	db.Delete([]byte("b"))
+
+	scan := func(query string) string {
+		return serve(api.ScanHandler, httptest.NewRequest("GET", "/scan?"+query, nil))
+	}
+
+	if got := scan(""); got != "{\"key\":\"a\",\"value\":\"a1\"}\n{\"key\":\"c\",\"value\":\"c1\"}\n{\"key\":\"d\",\"value\":\"d1\"}\n" {
+		t.Errorf("Scan of every key returned %q", got)
+	}
+	if got := scan("start=b&end=d"); got != "{\"key\":\"c\",\"value\":\"c1\"}\n" {
+		t.Errorf("Scan of [b, d) returned %q", got)
+	}
+	if got := scan("limit=3"); strings.Count(got, "\n") != 3 || strings.Contains(got, "cursor") {
+		t.Errorf("Scan with a limit of 3 returned %q, expected every key without a cursor", got)
+	}
+	if got := scan("limit=-1"); !strings.Contains(got, "Invalid limit") {
+		t.Errorf("Scan with a negative limit returned %q", got)
+	}
+}
+
+func TestPrefixScan(t *testing.T) {
+	db, err := zikodb.Open(t.TempDir(), &zikodb.Options{PrefixDelimiter: ":"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	api := NewKeyValueStoreAPI(db)
+
+	for _, key := range []string{"user:1:name", "user:1:profile", "user:10:name", "user:2:name"} {
+		db.Put([]byte(key), []byte("v"))
+	}
+
+	keys := serve(api.KeysHandler, httptest.NewRequest("GET", "/keys?prefix=user:1:", nil))
+	if keys != "{\"key\":\"user:1:name\"}\n{\"key\":\"user:1:profile\"}\n" {
+		t.Errorf("Keys under user:1: returned %q", keys)
+	}
+	scan := serve(api.ScanHandler, httptest.NewRequest("GET", "/scan?prefix=user:2:", nil))
+	if scan != "{\"key\":\"user:2:name\",\"value\":\"v\"}\n" {
+		t.Errorf("Scan of user:2: returned %q", scan)
+	}
+	if got := serve(api.KeysHandler, httptest.NewRequest("GET", "/keys?prefix=user:&start=a", nil)); !strings.Contains(got, "cannot be combined") {
+		t.Errorf("A prefix with a start returned %q", got)
+	}
+}
+
+// Page through the keys with cursors while keys get written around the
+// Position of the cursor
+func TestScanCursor(t *testing.T) {
+	db, err := zikodb.Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	api := NewKeyValueStoreAPI(db)
+
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		db.Put([]byte(key), []byte("1"))
+	}
+
+	// Split a page in its keys and its cursor
+	page := func(query string) ([]string, string) {
+		body := serve(api.KeysHandler, httptest.NewRequest("GET", "/keys?limit=2&"+query, nil))
+		var keys []string
+		var cursor string
+		for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+			var result struct{ Key, Cursor string }
+			if err := json.Unmarshal([]byte(line), &result); err != nil {
+				t.Fatalf("Invalid line %q", line)
+			}
+			if result.Cursor != "" {
+				cursor = result.Cursor
+			} else {
+				keys = append(keys, result.Key)
+			}
+		}
+		return keys, cursor
+	}
+
+	keys, cursor := page("")
+	if fmt.Sprint(keys) != "[a b]" || cursor == "" {
+		t.Fatalf("First page returned %v with cursor %q", keys, cursor)
+	}
+
+	// The key of the cursor and the ones before it are not returned again
+	db.Delete([]byte("b"))
+	db.Put([]byte("a1"), []byte("1"))
+	db.Put([]byte("bb"), []byte("1"))
+	keys, cursor = page("cursor=" + cursor)
+	if fmt.Sprint(keys) != "[bb c]" || cursor == "" {
+		t.Fatalf("Second page returned %v with cursor %q", keys, cursor)
+	}
+	if keys, cursor = page("cursor=" + cursor); fmt.Sprint(keys) != "[d e]" || cursor != "" {
+		t.Errorf("Last page returned %v with cursor %q", keys, cursor)
+	}
+
+	keys, cursor = page("reverse=true")
+	if fmt.Sprint(keys) != "[e d]" {
+		t.Fatalf("First reverse page returned %v", keys)
+	}
+	if keys, _ = page("reverse=true&cursor=" + cursor); fmt.Sprint(keys) != "[c bb]" {
+		t.Errorf("Second reverse page returned %v", keys)
+	}
+	if got := serve(api.KeysHandler, httptest.NewRequest("GET", "/keys?cursor="+cursor, nil)); !strings.Contains(got, "Invalid cursor") {
+		t.Errorf("A reverse cursor used forward returned %q", got)
+	}
+}
+
+func TestSnapshotHandler(t *testing.T) {
+	db, err := zikodb.Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	api := NewKeyValueStoreAPI(db)
+
+	db.Put([]byte("a"), []byte("1"))
+	var info snapshotInfo
+	body := serve(api.SnapshotHandler, httptest.NewRequest("POST", "/snapshot?ttl=1m", nil))
+	if err := json.Unmarshal([]byte(body), &info); err != nil || info.ID == "" || info.TTL != "1m0s" {
+		t.Fatalf("Creating a snapshot returned %q", body)
+	}
+	db.Put([]byte("a"), []byte("2"))
+	db.Put([]byte("b"), []byte("2"))
+
+	if got := serve(api.GetHandler, httptest.NewRequest("GET", "/get?key=a&snapshot="+info.ID, nil)); got != "Value: 1\n" {
+		t.Errorf("Get(a) in the snapshot returned %q", got)
+	}
+	if got := serve(api.KeysHandler, httptest.NewRequest("GET", "/keys?snapshot="+info.ID, nil)); got != "{\"key\":\"a\"}\n" {
+		t.Errorf("Keys in the snapshot returned %q", got)
+	}
+	if got := serve(api.GetHandler, httptest.NewRequest("GET", "/get?key=a", nil)); got != "Value: 2\n" {
+		t.Errorf("Get(a) returned %q", got)
+	}
+
+	if got := serve(api.SnapshotHandler, httptest.NewRequest("DELETE", "/snapshot?id="+info.ID, nil)); got != "OK\n" {
+		t.Errorf("Releasing the snapshot returned %q", got)
+	}
+	if got := serve(api.ScanHandler, httptest.NewRequest("GET", "/scan?snapshot="+info.ID, nil)); !strings.Contains(got, "Snapshot not found") {
+		t.Errorf("Scan of a released snapshot returned %q", got)
+	}
+
+	// An unused snapshot is released once its ttl is over
+	body = serve(api.SnapshotHandler, httptest.NewRequest("POST", "/snapshot?ttl=10ms", nil))
+	if err := json.Unmarshal([]byte(body), &info); err != nil {
+		t.Fatalf("Creating a snapshot returned %q", body)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := serve(api.GetHandler, httptest.NewRequest("GET", "/get?key=a&snapshot="+info.ID, nil)); !strings.Contains(got, "Snapshot not found") {
+		t.Errorf("Get in an expired snapshot returned %q", got)
+	}
+	if got := serve(api.SnapshotHandler, httptest.NewRequest("POST", "/snapshot?ttl=2h", nil)); !strings.Contains(got, "Invalid ttl") {
+		t.Errorf("A ttl over the maximum returned %q", got)
+	}
+}
+
+func TestBatchHandler(t *testing.T) {
+	db, err := zikodb.Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	api := NewKeyValueStoreAPI(db)
+
+	db.Put([]byte("a"), []byte("1"))
+	batch := func(body string) string {
+		return serve(api.BatchHandler, httptest.NewRequest("POST", "/batch", strings.NewReader(body)))
+	}
+
+	if got := batch(`[{"op": "set", "key": "b", "value": "2"}, {"op": "del", "key": "a"}]`); got != "OK\n" {
+		t.Errorf("Batch returned %q", got)
+	}
+	if got := serve(api.KeysHandler, httptest.NewRequest("GET", "/keys", nil)); got != "{\"key\":\"b\"}\n" {
+		t.Errorf("Keys after the batch returned %q", got)
+	}
+
+	// An invalid operation leaves the whole batch unwritten
+	for body, expected := range map[string]string{
+		`[{"op": "set", "key": "c", "value": "3"}, {"op": "put", "key": "d"}]`: "Unknown op",
+		`[{"op": "set", "key": "c", "value": "3"}, {"op": "set", "key": "d"}]`: "Value not provided",
+		`[{"op": "del"}]`:           "Key not provided",
+		`{"op": "del", "key": "b"}`: "Invalid JSON format",
+	} {
+		if got := batch(body); !strings.Contains(got, expected) {
+			t.Errorf("Batch %s returned %q, expected %q", body, got, expected)
+		}
+	}
+	if got := serve(api.KeysHandler, httptest.NewRequest("GET", "/keys", nil)); got != "{\"key\":\"b\"}\n" {
+		t.Errorf("Keys after the invalid batches returned %q", got)
+	}
+}
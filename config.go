@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/zakariaCHOUKRI/ZikoDB/zikodb"
+)
+
+// Settings of the server. They are read from the config file first, then
+// Overridden by the ZIKODB_* environment variables and lastly by the
+// Command line flags
+type Config struct {
+	DataDir       string `json:"data_dir"`
+	ListenAddress string `json:"listen_address"`
+
+	MemtableSize      int64                    `json:"memtable_size"`
+	MemtableEntries   int                      `json:"memtable_entries"`
+	FlushInterval     Duration                 `json:"flush_interval"`
+	Sync              zikodb.SyncMode          `json:"sync"`
+	SyncInterval      Duration                 `json:"sync_interval"`
+	StrictWALRecovery bool                     `json:"strict_wal_recovery"`
+	Compaction        zikodb.CompactionOptions `json:"compaction"`
+	ScrubInterval     Duration                 `json:"scrub_interval"`
+	ScrubRate         int64                    `json:"scrub_rate"`
+	PrefixDelimiter   string                   `json:"prefix_delimiter"`
+	BloomBitsPerKey   int                      `json:"bloom_bits_per_key"`
+}
+
+// A time.Duration written as "60s" or "1m30s" in the config file
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"60s\": %s", data)
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func defaultConfig() Config {
+	options := zikodb.DefaultOptions()
+	return Config{
+		DataDir:           "data",
+		ListenAddress:     ":8080",
+		MemtableSize:      options.MemtableSize,
+		MemtableEntries:   options.MemtableEntries,
+		FlushInterval:     Duration(options.FlushInterval),
+		Sync:              options.Sync,
+		SyncInterval:      Duration(options.SyncInterval),
+		StrictWALRecovery: options.StrictWALRecovery,
+		Compaction:        options.Compaction,
+		ScrubInterval:     Duration(options.ScrubInterval),
+		ScrubRate:         options.ScrubRate,
+		PrefixDelimiter:   options.PrefixDelimiter,
+		BloomBitsPerKey:   options.BloomBitsPerKey,
+	}
+}
+
+// Options of the database described by the config
+func (c Config) Options(logger *log.Logger) *zikodb.Options {
+	return &zikodb.Options{
+		MemtableSize:      c.MemtableSize,
+		MemtableEntries:   c.MemtableEntries,
+		FlushInterval:     time.Duration(c.FlushInterval),
+		Sync:              c.Sync,
+		SyncInterval:      time.Duration(c.SyncInterval),
+		StrictWALRecovery: c.StrictWALRecovery,
+		Compaction:        c.Compaction,
+		ScrubInterval:     time.Duration(c.ScrubInterval),
+		ScrubRate:         c.ScrubRate,
+		PrefixDelimiter:   c.PrefixDelimiter,
+		BloomBitsPerKey:   c.BloomBitsPerKey,
+		Logger:            logger,
+	}
+}
+
+// A setting that can be overridden by an environment variable and a flag,
+// Boolean flags can be given without a value
+type setting struct {
+	flag    string
+	env     string
+	usage   string
+	set     func(config *Config, value string) error
+	boolean bool
+}
+
+var settings = []setting{
+	{flag: "data-dir", env: "ZIKODB_DATA_DIR", usage: "directory holding the wal and the sst files", set: func(c *Config, v string) error {
+		c.DataDir = v
+		return nil
+	}},
+	{flag: "listen", env: "ZIKODB_LISTEN_ADDRESS", usage: "address the server listens on, e.g. :8080", set: func(c *Config, v string) error {
+		c.ListenAddress = v
+		return nil
+	}},
+	{flag: "memtable-size", env: "ZIKODB_MEMTABLE_SIZE", usage: "approximate number of bytes that triggers a flush of the memtable", set: func(c *Config, v string) error {
+		size, err := strconv.ParseInt(v, 10, 64)
+		c.MemtableSize = size
+		return err
+	}},
+	{flag: "memtable-entries", env: "ZIKODB_MEMTABLE_ENTRIES", usage: "number of entries that triggers a flush of the memtable, 0 for no limit", set: func(c *Config, v string) error {
+		entries, err := strconv.Atoi(v)
+		c.MemtableEntries = entries
+		return err
+	}},
+	{flag: "flush-interval", env: "ZIKODB_FLUSH_INTERVAL", usage: "how often the memtable is flushed, e.g. 60s", set: func(c *Config, v string) error {
+		interval, err := time.ParseDuration(v)
+		c.FlushInterval = Duration(interval)
+		return err
+	}},
+	{flag: "sync", env: "ZIKODB_SYNC", usage: "when the wal is synced: none, always or periodic", set: func(c *Config, v string) error {
+		c.Sync = zikodb.SyncMode(v)
+		return nil
+	}},
+	{flag: "sync-interval", env: "ZIKODB_SYNC_INTERVAL", usage: "how often the wal is synced in periodic mode, e.g. 100ms", set: func(c *Config, v string) error {
+		interval, err := time.ParseDuration(v)
+		c.SyncInterval = Duration(interval)
+		return err
+	}},
+	{flag: "strict-wal-recovery", env: "ZIKODB_STRICT_WAL_RECOVERY", usage: "refuse to start when the wal ends with a corrupt record", set: func(c *Config, v string) error {
+		strict, err := strconv.ParseBool(v)
+		c.StrictWALRecovery = strict
+		return err
+	}, boolean: true},
+	{flag: "bloom-bits-per-key", env: "ZIKODB_BLOOM_BITS_PER_KEY", usage: "bits of bloom filter per key of the new sst files, a negative value writes no filter", set: func(c *Config, v string) error {
+		bits, err := strconv.Atoi(v)
+		c.BloomBitsPerKey = bits
+		return err
+	}},
+	{flag: "compaction", env: "ZIKODB_COMPACTION", usage: "compaction strategy: leveled or size-tiered", set: func(c *Config, v string) error {
+		c.Compaction.Strategy = zikodb.CompactionStrategy(v)
+		return nil
+	}},
+	{flag: "scrub-interval", env: "ZIKODB_SCRUB_INTERVAL", usage: "how often the sst checksums are verified in the background, a negative value turns it off", set: func(c *Config, v string) error {
+		interval, err := time.ParseDuration(v)
+		c.ScrubInterval = Duration(interval)
+		return err
+	}},
+	{flag: "scrub-rate", env: "ZIKODB_SCRUB_RATE", usage: "bytes per second read at most by the scrubber", set: func(c *Config, v string) error {
+		rate, err := strconv.ParseInt(v, 10, 64)
+		c.ScrubRate = rate
+		return err
+	}},
+	{flag: "prefix-delimiter", env: "ZIKODB_PREFIX_DELIMITER", usage: "end of the key prefixes put in the prefix bloom filters, e.g. :", set: func(c *Config, v string) error {
+		c.PrefixDelimiter = v
+		return nil
+	}},
+}
+
+// Build the config from the defaults, the config file given by -config
+// Or ZIKODB_CONFIG, the environment and the command line arguments
+func loadConfig(args []string, getenv func(string) string) (Config, error) {
+	config := defaultConfig()
+
+	flags := flag.NewFlagSet("zikodb", flag.ContinueOnError)
+	configFile := flags.String("config", getenv("ZIKODB_CONFIG"), "path of a json config file")
+
+	// The flags are applied once the file and the environment are read
+	values := map[string]string{}
+	for _, s := range settings {
+		s := s
+		usage := fmt.Sprintf("%s (env %s)", s.usage, s.env)
+		record := func(value string) error {
+			values[s.flag] = value
+			return nil
+		}
+		if s.boolean {
+			flags.BoolFunc(s.flag, usage, record)
+		} else {
+			flags.Func(s.flag, usage, record)
+		}
+	}
+	if err := flags.Parse(args); err != nil {
+		return config, err
+	}
+
+	if *configFile != "" {
+		if err := readConfigFile(*configFile, &config); err != nil {
+			return config, err
+		}
+	}
+
+	for _, s := range settings {
+		if value := getenv(s.env); value != "" {
+			if err := s.set(&config, value); err != nil {
+				return config, fmt.Errorf("invalid %s: %v", s.env, err)
+			}
+		}
+	}
+
+	for _, s := range settings {
+		if value, ok := values[s.flag]; ok {
+			if err := s.set(&config, value); err != nil {
+				return config, fmt.Errorf("invalid -%s: %v", s.flag, err)
+			}
+		}
+	}
+
+	return config, nil
+}
+
+func readConfigFile(filename string, config *Config) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Unknown fields are rejected so typos do not go unnoticed
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil && err != io.EOF {
+		return fmt.Errorf("reading %s: %v", filename, err)
+	}
+	return nil
+}
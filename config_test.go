@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zakariaCHOUKRI/ZikoDB/zikodb"
+)
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	content := `{"data_dir": "from-file", "listen_address": ":9000", "memtable_size": 10,
+		"flush_interval": "5s", "compaction": {"strategy": "size-tiered"}}`
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{
+		"ZIKODB_CONFIG":        file,
+		"ZIKODB_MEMTABLE_SIZE": "20",
+		"ZIKODB_DATA_DIR":      "from-env",
+	}
+	config, err := loadConfig([]string{"-data-dir", "from-flag", "-sync", "always", "-bloom-bits-per-key", "16"}, func(key string) string {
+		return env[key]
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.DataDir != "from-flag" {
+		t.Errorf("DataDir = %q, expected the flag to win", config.DataDir)
+	}
+	if config.MemtableSize != 20 {
+		t.Errorf("MemtableSize = %d, expected the environment to win", config.MemtableSize)
+	}
+	if config.ListenAddress != ":9000" || time.Duration(config.FlushInterval) != 5*time.Second {
+		t.Errorf("ListenAddress = %q, FlushInterval = %v, expected the file values", config.ListenAddress, config.FlushInterval)
+	}
+	if config.Sync != zikodb.SyncAlways || config.Compaction.Strategy != zikodb.SizeTieredCompaction {
+		t.Errorf("Sync = %q, Strategy = %q", config.Sync, config.Compaction.Strategy)
+	}
+
+	if config.Options(nil).BloomBitsPerKey != 16 {
+		t.Errorf("BloomBitsPerKey = %d, expected the flag value", config.BloomBitsPerKey)
+	}
+
+	// Settings nobody mentions keep their default
+	if config.Compaction.L0Trigger != 4 {
+		t.Errorf("L0Trigger = %d, expected the default", config.Compaction.L0Trigger)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	noEnv := func(string) string { return "" }
+
+	file := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(file, []byte(`{"memtable_sise": 10}`), 0644)
+	if _, err := loadConfig([]string{"-config", file}, noEnv); err == nil {
+		t.Errorf("expected an error for an unknown field")
+	}
+
+	if _, err := loadConfig([]string{"-memtable-size", "many"}, noEnv); err == nil {
+		t.Errorf("expected an error for a memtable size that is not a number")
+	}
+}
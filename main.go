@@ -1,133 +1,75 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/zakariaCHOUKRI/ZikoDB/zikodb"
 )
 
 func main() {
-	// WAL and memtable initialization
-	memtable := NewMemtable()
-	wal, err := NewWAL("data/wal/wal")
-	if err != nil {
-		fmt.Println("Error creating WAL:", err)
+	if len(os.Args) > 1 && os.Args[1] == "repair" {
+		if err := runRepair(os.Args[2:], os.Getenv, os.Stdout); err != nil && err != flag.ErrHelp {
+			fmt.Println("Error repairing database:", err)
+			os.Exit(1)
+		}
 		return
 	}
 
-	// Integrity check of sst files using checksums and
-	// Flushing values present in the wal from previous sessions
-	integrityCheck()
-	wal.flushWAL(memtable)
+	config, err := loadConfig(os.Args[1:], os.Getenv)
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		fmt.Println("Error loading config:", err)
+		os.Exit(2)
+	}
 
-	// Start the periodic flush goroutine
-	go periodicFlush(memtable)
+	// Open the database, this replays the wal of the last run
+	db, err := zikodb.Open(config.DataDir, config.Options(log.New(os.Stdout, "", 0)))
+	if err != nil {
+		fmt.Println("Error opening database:", err)
+		return
+	}
 
-	// Start the API
-	go StartAPI(memtable, wal)
+	// Close the database cleanly on ctrl-c
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		if err := db.Close(); err != nil {
+			fmt.Println("Error closing database:", err)
+		}
+		os.Exit(0)
+	}()
 
 	// Serve the web page
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "index.html")
 	})
 
-	// Start the web server
-	port := 8080
-	fmt.Printf("Web page available at http://localhost:%d\n", port)
-	http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
-
-	// memtable := NewMemtable()
-	// wal, err := NewWAL("data/wal/wal")
-	// if err != nil {
-	// 	fmt.Println("Error creating WAL:", err)
-	// 	return
-	// }
-
-	// memtable.Set([]byte("zakaria"), []byte("choukri"))
-
-	// //Start the API
-	// go StartAPI(memtable, wal)
-
-	// // Serve the web page
-	// http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-	// 	http.ServeFile(w, r, "index.html")
-	// })
-
-	// // Start the web server
-	// port := 8080
-	// fmt.Printf("Web page available at http://localhost:%d\n", port)
-	// http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
-
-	// memtable := NewMemtable()
-	// memtable.Set([]byte("key1"), []byte("value0"))
-	// memtable.Set([]byte("1"), 2)
-	// memtable.Set([]byte("2"), 4)
-	// memtable.Set([]byte("3"), 6)
-	// memtable.Set([]byte("4"), 8)
-	// memtable.Set([]byte("key2"), []byte("value2"))
-
-	// fmt.Println("the contents of memtable are")
-	// for i := memtable.data.Front(); i != nil; i = i.Next() {
-	// 	fmt.Println(i.Key(), i.Value)
-	// }
-
-	// fmt.Println("deletion of element with key '4'")
-	// memtable.Del([]byte("4"))
-	// fmt.Println("set key1 value1")
-	// memtable.Set([]byte("key1"), []byte("value1"))
-	// fmt.Println("the contents of memtable are")
-	// for i := memtable.data.Front(); i != nil; i = i.Next() {
-	// 	fmt.Println(i.Key(), i.Value)
-	// }
-
-	// flush(memtable)
-	// fmt.Println("the contents of memtable are")
-	// for i := memtable.data.Front(); i != nil; i = i.Next() {
-	// 	fmt.Println(i.Key(), i.Value)
-	// }
-
-	// memtable.Set([]byte("zakaria"), []byte("choukri"))
-	// memtable.Set([]byte("choukri"), []byte("zakaria"))
-
-	// fmt.Println("the contents of memtable are")
-	// for i := memtable.data.Front(); i != nil; i = i.Next() {
-	// 	fmt.Println(i.Key(), i.Value)
-	// }
-	// time.Sleep(10 * time.Second)
-	// flush(memtable)
-	// fmt.Println("the contents of memtable are")
-	// for i := memtable.data.Front(); i != nil; i = i.Next() {
-	// 	fmt.Println(i.Key(), i.Value)
-	// }
-
-	// wal, err := NewWAL("data/wal/wal1.wal")
-	// if err != nil {
-	// 	log.Fatal(err)
-	// }
-	// defer wal.Close()
-
-	// // Example 1: Set operation
-	// setEntry := &WALEntry{
-	// 	Action: 's',
-	// 	Key:    []byte("example_key"),
-	// 	Value:  []byte("example_value"),
-	// }
-
-	// if err := wal.Write(setEntry); err != nil {
-	// 	log.Fatal(err)
-	// }
-
-	// // Example 2: Delete operation
-	// deleteEntry := &WALEntry{
-	// 	Action: 'd',
-	// 	Key:    []byte("example_key"),
-	// }
-
-	// if err := wal.Write(deleteEntry); err != nil {
-	// 	log.Fatal(err)
-	// }
-
-	// // Add more entries as needed
-
-	// log.Println("WAL entries written successfully.")
+	// Start the API and the web server
+	fmt.Printf("Web page available at %s\n", pageURL(config.ListenAddress))
+	if err := StartAPI(db, config.ListenAddress); err != nil {
+		fmt.Println("Error starting server:", err)
+		db.Close()
+	}
+}
 
+// Url of the web page served on address
+func pageURL(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "http://" + address
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port)
 }
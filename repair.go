@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/zakariaCHOUKRI/ZikoDB/zikodb"
+)
+
+// Salvage what can still be read from a damaged data directory into a
+// New one, the damaged directory is left as it is:
+//
+//	zikodb repair [-data-dir data] [-out data.repaired]
+func runRepair(args []string, getenv func(string) string, out io.Writer) error {
+	dataDir := getenv("ZIKODB_DATA_DIR")
+	if dataDir == "" {
+		dataDir = defaultConfig().DataDir
+	}
+
+	flags := flag.NewFlagSet("zikodb repair", flag.ContinueOnError)
+	flags.StringVar(&dataDir, "data-dir", dataDir, "directory of the damaged database (env ZIKODB_DATA_DIR)")
+	outDir := flags.String("out", "", "directory of the repaired database, the data dir followed by .repaired by default")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *outDir == "" {
+		*outDir = dataDir + ".repaired"
+	}
+
+	report, err := zikodb.Repair(dataDir, *outDir, &zikodb.Options{Logger: log.New(io.Discard, "", 0)})
+	if err != nil {
+		return err
+	}
+
+	for _, file := range report.Files {
+		if file.Error != "" {
+			fmt.Fprintf(out, "%s: unreadable, %d bytes lost (%s)\n", file.Name, file.LostBytes, file.Error)
+			continue
+		}
+		fmt.Fprintf(out, "%s: %d entries salvaged, %d bytes lost\n", file.Name, file.Entries, file.LostBytes)
+	}
+	fmt.Fprintf(out, "Wrote %d keys to %s, %d bytes could not be read\n", report.Keys, *outDir, report.LostBytes())
+	return nil
+}
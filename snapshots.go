@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/zakariaCHOUKRI/ZikoDB/zikodb"
+)
+
+// Time a snapshot created over http is kept without being used when the
+// Request does not give one, and the longest a request can ask for
+const (
+	defaultSnapshotTTL = time.Minute
+	maxSnapshotTTL     = time.Hour
+)
+
+// The snapshots handed out over http by id. A client can go away without
+// Releasing its snapshot, so every snapshot is released once it goes
+// Unused for its ttl, each use starts the ttl over
+type snapshotRegistry struct {
+	mu        sync.Mutex
+	snapshots map[string]*heldSnapshot
+}
+
+type heldSnapshot struct {
+	snapshot *zikodb.Snapshot
+	ttl      time.Duration
+	timer    *time.Timer
+}
+
+func newSnapshotRegistry() *snapshotRegistry {
+	return &snapshotRegistry{snapshots: map[string]*heldSnapshot{}}
+}
+
+// Keep snapshot under a new random id until it is released or expires
+func (r *snapshotRegistry) add(snapshot *zikodb.Snapshot, ttl time.Duration) (string, error) {
+	var random [16]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(random[:])
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.snapshots[id] = &heldSnapshot{
+		snapshot: snapshot,
+		ttl:      ttl,
+		timer:    time.AfterFunc(ttl, func() { r.release(id) }),
+	}
+	return id, nil
+}
+
+// The snapshot kept under id, this starts its ttl over
+func (r *snapshotRegistry) get(id string) (*zikodb.Snapshot, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	held, ok := r.snapshots[id]
+	if !ok {
+		return nil, false
+	}
+	held.timer.Reset(held.ttl)
+	return held.snapshot, true
+}
+
+// Release the snapshot kept under id, reads already using it finish
+// Normally or fail with zikodb.ErrSnapshotReleased
+func (r *snapshotRegistry) release(id string) bool {
+	r.mu.Lock()
+	held, ok := r.snapshots[id]
+	delete(r.snapshots, id)
+	r.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+	held.timer.Stop()
+	held.snapshot.Release()
+	return true
+}
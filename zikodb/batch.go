@@ -0,0 +1,53 @@
+package zikodb
+
+// A WriteBatch collects puts and deletes that DB.Write applies at once.
+// The keys and values are copied, so their buffers can be reused as
+// Soon as Put or Delete returns. The zero value is an empty batch
+type WriteBatch struct {
+	entries []entry
+}
+
+// Set key to value when the batch is written
+func (b *WriteBatch) Put(key []byte, value []byte) {
+	b.entries = append(b.entries, entry{
+		Kind:  kindSet,
+		Key:   append([]byte{}, key...),
+		Value: append([]byte{}, value...),
+	})
+}
+
+// Delete key when the batch is written
+func (b *WriteBatch) Delete(key []byte) {
+	b.entries = append(b.entries, entry{Kind: kindDelete, Key: append([]byte{}, key...)})
+}
+
+// Number of writes in the batch
+func (b *WriteBatch) Len() int {
+	return len(b.entries)
+}
+
+// Empty the batch so that it can be filled again
+func (b *WriteBatch) Reset() {
+	b.entries = b.entries[:0]
+}
+
+// Apply the writes of batch atomically and in order, a later write of a
+// Key wins over an earlier one. They are logged as a single wal record
+// And made visible at once, so reads, iterators and snapshots see all of
+// Them or none, and after a crash either all of them are recovered or
+// None. Like Put, this returns once the batch is in the wal and synced
+// With SyncAlways
+func (db *DB) Write(batch *WriteBatch) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+	if len(batch.entries) == 0 {
+		return nil
+	}
+
+	// The entries get numbered, the batch itself can be written again
+	return db.memtable.put(append([]entry{}, batch.entries...)...)
+}
@@ -0,0 +1,161 @@
+package zikodb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestWALBatchRecord(t *testing.T) {
+	wal, err := newWAL(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	path := wal.file.Name()
+
+	wal.Write(&walEntry{Action: 'S', Seq: 1, Key: []byte("a"), Value: []byte("1")})
+	wal.WriteBatch([]walEntry{
+		{Action: 'S', Seq: 2, Key: []byte("b"), Value: []byte("2")},
+		{Action: 'D', Seq: 3, Key: []byte("a")},
+		{Action: 'S', Seq: 4, Key: []byte("c"), Value: []byte("4")},
+	})
+
+	entries, err := readWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("Read %d entries, expected 4", len(entries))
+	}
+	for i, expected := range []walEntry{{Action: 'S', Seq: 1, Key: []byte("a")}, {Action: 'S', Seq: 2, Key: []byte("b")}, {Action: 'D', Seq: 3, Key: []byte("a")}, {Action: 'S', Seq: 4, Key: []byte("c")}} {
+		if entries[i].Action != expected.Action || entries[i].Seq != expected.Seq || string(entries[i].Key) != string(expected.Key) {
+			t.Errorf("Entry %d is %v, expected %v", i, entries[i], expected)
+		}
+	}
+
+	// A batch whose count claims more entries than its record holds
+	record := encodeWALBatch([]walEntry{{Action: 'S', Seq: 5, Key: []byte("d")}, {Action: 'S', Seq: 6, Key: []byte("e")}})
+	record[walFrameHeaderSize+8+3] = 3
+	record = frameWALRecord(record)
+	if _, _, reason := decodeWALRecord(record); reason == "" {
+		t.Errorf("A batch with a wrong count was decoded")
+	}
+}
+
+func TestDBWriteBatch(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir, nil)
+	db.Put([]byte("a"), []byte("1"))
+
+	var batch WriteBatch
+	key := []byte("b")
+	batch.Put(key, []byte("2"))
+	key[0] = 'x'
+	batch.Delete([]byte("a"))
+	batch.Put([]byte("c"), []byte("2"))
+	batch.Put([]byte("c"), []byte("3"))
+	if err := db.Write(&batch); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(stage string) {
+		t.Helper()
+		if got := scan(t, db, nil, nil); got != "b=2 c=3 " {
+			t.Errorf("%s: scan returned %q", stage, got)
+		}
+	}
+	check("written")
+
+	db.Close()
+	db = openTestDB(t, dir, nil)
+	check("reopened")
+	db.Put([]byte("z"), []byte("1"))
+	batch.Reset()
+	batch.Put([]byte("d"), []byte("4"))
+	batch.Delete([]byte("b"))
+	db.Write(&batch)
+	db.Close()
+
+	// The batch is the last record of the segment, tearing it loses
+	// Every write of the batch
+	path := filepath.Join(dir, "wal", walSegmentName(2))
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Truncate(path, info.Size()-1)
+
+	db = openTestDB(t, dir, nil)
+	if got := scan(t, db, nil, nil); got != "b=2 c=3 z=1 " {
+		t.Errorf("Scan after tearing the batch returned %q", got)
+	}
+	if err := db.Write(&WriteBatch{}); err != nil {
+		t.Errorf("Writing an empty batch returned %v", err)
+	}
+	db.Close()
+	if err := db.Write(&batch); !errors.Is(err, ErrClosed) {
+		t.Errorf("Write after Close returned %v", err)
+	}
+}
+
+// Iterators and reads made while batches are written see both keys of a
+// Batch or neither of them
+func TestWriteBatchIsAtomic(t *testing.T) {
+	db := openTestDB(t, t.TempDir(), &Options{MemtableEntries: 50})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 500; i++ {
+			var batch WriteBatch
+			batch.Put([]byte("a"), []byte(fmt.Sprint(i)))
+			batch.Put([]byte("b"), []byte(fmt.Sprint(i)))
+			if err := db.Write(&batch); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		it, err := db.NewIterator(nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var values []string
+		for ; it.Valid(); it.Next() {
+			values = append(values, string(it.Value()))
+		}
+		it.Close()
+		if len(values) == 2 && values[0] != values[1] || len(values) == 1 {
+			t.Fatalf("Iterator saw half a batch: %v", values)
+		}
+
+		// Once a batch is seen through a, b is read after it and can
+		// Only be as new or newer
+		a, errA := db.Get([]byte("a"))
+		b, errB := db.Get([]byte("b"))
+		if errA == nil && (errB != nil || atoi(t, b) < atoi(t, a)) {
+			t.Fatalf("Get saw half a batch: a=%s b=%s %v", a, b, errB)
+		}
+	}
+}
+
+func atoi(t *testing.T, value []byte) int {
+	t.Helper()
+
+	n, err := strconv.Atoi(string(value))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
@@ -0,0 +1,84 @@
+package zikodb
+
+import "hash/fnv"
+
+// Bloom filter over the keys of an sst file. It is built from the
+// Hashes of the keys and probed with double hashing, the same way
+// Leveldb does it, so a single hash computation is needed per key
+type bloomFilter struct {
+	bits []byte
+	k    uint8
+}
+
+func bloomHash(key []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(key)
+	return h.Sum32()
+}
+
+func newBloomFilter(hashes []uint32, bitsPerKey int) *bloomFilter {
+	// Using ln(2) * bitsPerKey hash functions minimizes
+	// The false positive rate
+	k := uint8(float64(bitsPerKey) * 0.69)
+	if k < 1 {
+		k = 1
+	}
+	if k > 30 {
+		k = 30
+	}
+
+	nbits := len(hashes) * bitsPerKey
+	if nbits < 64 {
+		nbits = 64
+	}
+	f := &bloomFilter{
+		bits: make([]byte, (nbits+7)/8),
+		k:    k,
+	}
+
+	nbits = len(f.bits) * 8
+	for _, h := range hashes {
+		delta := h>>17 | h<<15
+		for i := uint8(0); i < f.k; i++ {
+			bit := h % uint32(nbits)
+			f.bits[bit/8] |= 1 << (bit % 8)
+			h += delta
+		}
+	}
+
+	return f
+}
+
+// Whether key may be in the set, false means it is definitely not
+func (f *bloomFilter) mayContain(key []byte) bool {
+	nbits := uint32(len(f.bits) * 8)
+	if nbits == 0 {
+		return true
+	}
+
+	h := bloomHash(key)
+	delta := h>>17 | h<<15
+	for i := uint8(0); i < f.k; i++ {
+		bit := h % nbits
+		if f.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+		h += delta
+	}
+	return true
+}
+
+// The filter block is the bit array followed by the number of probes
+func (f *bloomFilter) encode() []byte {
+	return append(append([]byte{}, f.bits...), f.k)
+}
+
+func decodeBloomFilter(data []byte) (*bloomFilter, bool) {
+	if len(data) < 1 {
+		return nil, false
+	}
+	return &bloomFilter{
+		bits: data[:len(data)-1],
+		k:    data[len(data)-1],
+	}, true
+}
@@ -0,0 +1,80 @@
+package zikodb
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	var hashes []uint32
+	for i := 0; i < 10000; i++ {
+		hashes = append(hashes, bloomHash([]byte(fmt.Sprintf("key%d", i))))
+	}
+	filter, _ := decodeBloomFilter(newBloomFilter(hashes, 10).encode())
+
+	for i := 0; i < 10000; i++ {
+		if !filter.mayContain([]byte(fmt.Sprintf("key%d", i))) {
+			t.Fatalf("Filter rejected key%d which was added", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if filter.mayContain([]byte(fmt.Sprintf("absent%d", i))) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 300 {
+		t.Errorf("%d false positives out of 10000, expected around 1%%", falsePositives)
+	}
+}
+
+func TestSSTBloomBitsPerKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.sst")
+	sst, err := newSSTFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sst.bitsPerKey = 0
+	for _, entry := range testEntries(100) {
+		sst.Add(entry)
+	}
+	if err := sst.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	sst.Close()
+
+	reader, err := openSST(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if reader.filter != nil {
+		t.Errorf("A file written with 0 bits per key should carry no filter")
+	}
+	if entry, ok, err := reader.get([]byte("key00001"), maxSequence); err != nil || !ok || string(entry.Value) != "value1" {
+		t.Errorf("Get(key00001) = %q %v %v", entry.Value, ok, err)
+	}
+}
+
+func TestSSTFilterCountsFalsePositives(t *testing.T) {
+	reader := writeTestSST(t, testEntries(1000))
+	if reader.filter == nil {
+		t.Fatal("Expected the sst file to carry a bloom filter")
+	}
+
+	// Keys between the smallest and the largest key of the file
+	for i := 0; i < 999; i++ {
+		reader.get([]byte(fmt.Sprintf("key%05da", i)), maxSequence)
+	}
+
+	negatives := reader.filterNegatives.Load()
+	falsePositives := reader.filterFalsePositives.Load()
+	if negatives+falsePositives != 999 {
+		t.Errorf("Expected 999 filtered lookups, got %d", negatives+falsePositives)
+	}
+	if rate := reader.FalsePositiveRate(); rate > 0.05 {
+		t.Errorf("False positive rate is %f", rate)
+	}
+}
@@ -0,0 +1,429 @@
+package zikodb
+
+import (
+	"bytes"
+	"os"
+	"time"
+)
+
+const (
+	// How often to check whether a compaction is needed,
+	// Flushes also wake the compactor up
+	compactionInterval = time.Second * 30
+)
+
+type CompactionStrategy string
+
+const (
+	// Leveldb style leveling: flushed files are merged into level 1
+	// And every level is kept under a target size by pushing files
+	// Into the next, bigger, level
+	LeveledCompaction CompactionStrategy = "leveled"
+
+	// Similarly sized level 0 files are merged together, which
+	// Writes every entry fewer times at the cost of more files
+	SizeTieredCompaction CompactionStrategy = "size-tiered"
+)
+
+type CompactionOptions struct {
+	Strategy CompactionStrategy `json:"strategy"`
+
+	// Number of level 0 files that triggers their compaction into level 1
+	L0Trigger int `json:"l0_trigger"`
+
+	// Target size of level 1
+	BaseLevelSize int64 `json:"base_level_size"`
+
+	// Size ratio between a level and the one above it, starting with
+	// The ratio between level 2 and level 1. The last ratio is used
+	// For all the deeper levels
+	LevelSizeMultipliers []float64 `json:"level_size_multipliers"`
+
+	// Size after which a compaction output is split into a new file
+	TargetFileSize int64 `json:"target_file_size"`
+
+	// Minimum number of similarly sized files merged by the size-tiered strategy
+	MinMergeWidth int `json:"min_merge_width"`
+
+	// Files belong to the same tier when their size is within this
+	// Ratio of the average size of the tier
+	TierSizeRatio float64 `json:"tier_size_ratio"`
+}
+
+func (o *CompactionOptions) setDefaults() {
+	if o.Strategy == "" {
+		o.Strategy = LeveledCompaction
+	}
+	if o.L0Trigger <= 0 {
+		o.L0Trigger = 4
+	}
+	if o.BaseLevelSize <= 0 {
+		o.BaseLevelSize = 10 * 1024 * 1024
+	}
+	if len(o.LevelSizeMultipliers) == 0 {
+		o.LevelSizeMultipliers = []float64{10}
+	}
+	if o.TargetFileSize <= 0 {
+		o.TargetFileSize = 2 * 1024 * 1024
+	}
+	if o.MinMergeWidth <= 0 {
+		o.MinMergeWidth = 4
+	}
+	if o.TierSizeRatio < 1 {
+		o.TierSizeRatio = 1.5
+	}
+}
+
+// Maximum size of a level before it gets compacted into the next one
+func (o CompactionOptions) levelTargetSize(level int) int64 {
+	size := float64(o.BaseLevelSize)
+	for i := 2; i <= level; i++ {
+		multiplier := 10.0
+		if len(o.LevelSizeMultipliers) > 0 {
+			multiplier = o.LevelSizeMultipliers[len(o.LevelSizeMultipliers)-1]
+			if i-2 < len(o.LevelSizeMultipliers) {
+				multiplier = o.LevelSizeMultipliers[i-2]
+			}
+		}
+		size *= multiplier
+	}
+	return int64(size)
+}
+
+// Wake the background compactor up without waiting for it
+func (s *tableSet) scheduleCompaction() {
+	select {
+	case s.compactionSignal <- struct{}{}:
+	default:
+	}
+}
+
+// Compact the sst files in the background whenever the strategy finds
+// Something to do until closing is closed, this runs alongside reads
+// And flushes. It is the only goroutine that removes files from the set
+func (s *tableSet) backgroundCompaction(closing <-chan struct{}) {
+	for {
+		select {
+		case <-s.compactionSignal:
+		case <-time.After(compactionInterval):
+		case <-closing:
+			return
+		}
+
+		for {
+			compacted, err := s.compact()
+			if err != nil {
+				s.logger.Println("Error compacting SST files:", err)
+			}
+			if err != nil || !compacted {
+				break
+			}
+		}
+	}
+}
+
+// A compaction picked by one of the strategies
+type compaction struct {
+	level       int
+	outputLevel int
+
+	// Input files from the newest to the oldest
+	inputs []*sstReader
+
+	// Whether no file left out of the compaction could hold an older
+	// Version of key, in which case its tombstone can be dropped
+	isBaseLevel func(key []byte) bool
+
+	// Size-tiered compactions write a single file that takes the
+	// Place of the inputs in level 0
+	inPlace bool
+}
+
+// Run a single compaction if the configured strategy finds one to do
+func (s *tableSet) compact() (bool, error) {
+	s.mu.RLock()
+	var c *compaction
+	if s.options.Strategy == SizeTieredCompaction {
+		c = s.pickSizeTiered()
+	} else {
+		c = s.pickLeveled()
+	}
+	s.mu.RUnlock()
+
+	if c == nil {
+		return false, nil
+	}
+
+	outputs, err := s.runCompaction(c)
+	if err != nil {
+		return false, err
+	}
+
+	if err := s.install(c, outputs); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Pick the level that is the most over its target, level 0 is scored
+// By its number of files and deeper levels by their size. The caller
+// Must hold the lock
+func (s *tableSet) pickLeveled() *compaction {
+	level := -1
+	best := 1.0
+	if score := float64(len(s.levels[0])) / float64(s.options.L0Trigger); score >= best {
+		level, best = 0, score
+	}
+	for i := 1; i < numLevels-1; i++ {
+		if score := float64(s.levelSize(i)) / float64(s.options.levelTargetSize(i)); score >= best {
+			level, best = i, score
+		}
+	}
+	if level < 0 {
+		return nil
+	}
+
+	c := &compaction{level: level, outputLevel: level + 1}
+
+	// Every level 0 file takes part since they overlap each other,
+	// Deeper levels give up one file at a time in a round robin
+	if level == 0 {
+		c.inputs = newestFirst(s.levels[0])
+	} else {
+		files := s.levels[level]
+		picked := files[0]
+		for _, sst := range files {
+			if bytes.Compare(sst.smallestKey, s.compactPointer[level]) > 0 {
+				picked = sst
+				break
+			}
+		}
+		c.inputs = []*sstReader{picked}
+	}
+
+	smallest, largest := keyRange(c.inputs)
+	if smallest == nil {
+		return nil
+	}
+	c.inputs = append(c.inputs, s.overlapping(c.outputLevel, smallest, largest)...)
+
+	var deeper []*sstReader
+	for i := c.outputLevel + 1; i < numLevels; i++ {
+		deeper = append(deeper, s.levels[i]...)
+	}
+	c.isBaseLevel = func(key []byte) bool {
+		for _, sst := range deeper {
+			if sst.mayContain(key) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return c
+}
+
+// Look for a run of consecutive level 0 files of similar sizes, from
+// The newest files to the oldest. Only consecutive files are merged so
+// That the output can take their place in the level. The caller must
+// Hold the lock
+func (s *tableSet) pickSizeTiered() *compaction {
+	files := s.levels[0]
+	for end := len(files); end >= s.options.MinMergeWidth; end-- {
+		start := end - 1
+		total := files[start].size
+		for start > 0 {
+			average := float64(total) / float64(end-start)
+			size := float64(files[start-1].size)
+			if size > average*s.options.TierSizeRatio || size < average/s.options.TierSizeRatio {
+				break
+			}
+			start--
+			total += files[start].size
+		}
+
+		if end-start >= s.options.MinMergeWidth {
+			bottom := start == 0
+			for i := 1; i < numLevels; i++ {
+				bottom = bottom && len(s.levels[i]) == 0
+			}
+			return &compaction{
+				inputs:      newestFirst(files[start:end]),
+				isBaseLevel: func(key []byte) bool { return bottom },
+				inPlace:     true,
+			}
+		}
+	}
+	return nil
+}
+
+func newestFirst(files []*sstReader) []*sstReader {
+	reversed := make([]*sstReader, len(files))
+	for i, sst := range files {
+		reversed[len(files)-1-i] = sst
+	}
+	return reversed
+}
+
+// Smallest and largest keys of a set of files
+func keyRange(files []*sstReader) ([]byte, []byte) {
+	var smallest, largest []byte
+	for _, sst := range files {
+		if sst.entryCount == 0 {
+			continue
+		}
+		if smallest == nil || bytes.Compare(sst.smallestKey, smallest) < 0 {
+			smallest = sst.smallestKey
+		}
+		if largest == nil || bytes.Compare(sst.largestKey, largest) > 0 {
+			largest = sst.largestKey
+		}
+	}
+	return smallest, largest
+}
+
+// Merge the inputs into new files, only the entry of each key with the
+// Highest sequence number is kept along with the versions snapshots
+// Still see. Leveled compactions split their output in files of the
+// Target size while size-tiered ones write a single file. The outputs
+// Are not live until the manifest records them
+func (s *tableSet) runCompaction(c *compaction) ([]string, error) {
+	var outputs []string
+	var output *sstFile
+
+	abort := func(err error) ([]string, error) {
+		if output != nil {
+			output.Close()
+		}
+		for _, filename := range outputs {
+			os.Remove(filename)
+		}
+		return nil, err
+	}
+
+	iters := make([]entryIterator, len(c.inputs))
+	for i, input := range c.inputs {
+		iters[i] = input.NewIterator()
+	}
+
+	// A version of a key is kept when it is the newest one or when a
+	// Snapshot sees it, that is when the snapshot was taken after it but
+	// Before the next version. Tombstones older than every snapshot are
+	// Dropped along with what they hide once no older file can hold it
+	oldestSnapshot := s.snapshots.oldest()
+	var key []byte
+	var next uint64
+	hidden := false
+
+	merged := newMergingIterator(iters)
+	merged.allVersions = true
+	for merged.SeekToFirst(); merged.Valid(); merged.Next() {
+		entry := merged.Entry()
+		newKey := key == nil || !bytes.Equal(entry.Key, key)
+		if !newKey && (hidden || entry.Seq >= next) {
+			continue
+		}
+
+		keep := newKey || s.snapshots.needs(entry.Seq, next)
+		key, next = entry.Key, entry.Seq
+		hidden = false
+		if !keep {
+			continue
+		}
+		if entry.IsDeleted() && entry.Seq <= oldestSnapshot && c.isBaseLevel(entry.Key) {
+			hidden = true
+			continue
+		}
+
+		// The versions of a key stay in one file so that the files of
+		// A level never overlap
+		if output != nil && !c.inPlace && newKey && int64(output.offset) >= s.options.TargetFileSize {
+			if err := output.Finish(); err != nil {
+				return abort(err)
+			}
+			output.Close()
+			output = nil
+		}
+
+		if output == nil {
+			filename := s.newTableFile()
+			var err error
+			if output, err = newSSTFile(filename); err != nil {
+				return abort(err)
+			}
+			output.prefixDelimiter = s.prefixDelimiter
+			output.bitsPerKey = s.bloomBitsPerKey
+			outputs = append(outputs, filename)
+		}
+
+		if err := output.Add(entry); err != nil {
+			return abort(err)
+		}
+	}
+	if err := merged.Err(); err != nil {
+		return abort(err)
+	}
+
+	if output != nil {
+		if err := output.Finish(); err != nil {
+			return abort(err)
+		}
+		output.Close()
+	}
+
+	return outputs, nil
+}
+
+// Swap the compaction inputs for its outputs with a single manifest
+// Edit, then remove the inputs. The outputs carry the highest sequence
+// Number of the inputs, which puts the output of a size-tiered
+// Compaction at the place of its inputs in level 0
+func (s *tableSet) install(c *compaction, outputs []string) error {
+	var seq uint64
+	for _, input := range c.inputs {
+		if input.seq > seq {
+			seq = input.seq
+		}
+	}
+
+	abort := func(err error) error {
+		for _, filename := range outputs {
+			os.Remove(filename)
+		}
+		return err
+	}
+
+	var added []*sstReader
+	for _, filename := range outputs {
+		output, err := openSST(filename)
+		if err != nil {
+			return abort(err)
+		}
+		output.seq = seq
+		added = append(added, output)
+	}
+
+	if err := s.replace(c.inputs, c.outputLevel, added); err != nil {
+		for _, output := range added {
+			output.Close()
+		}
+		return abort(err)
+	}
+	if c.level > 0 {
+		s.mu.Lock()
+		_, s.compactPointer[c.level] = keyRange(c.inputs[:1])
+		s.mu.Unlock()
+	}
+
+	// Lookups hold the read lock for their whole duration, only the
+	// Iterators still reading an input keep it on disk until they close
+	for _, input := range c.inputs {
+		input.obsolete.Store(true)
+		if err := input.unref(); err != nil {
+			return err
+		}
+	}
+
+	s.logger.Printf("Compacted %d SST files of level %d into %d files of level %d\n", len(c.inputs), c.level, len(added), c.outputLevel)
+	return nil
+}
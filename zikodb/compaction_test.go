@@ -0,0 +1,277 @@
+package zikodb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+)
+
+// A table set backed by an empty directory
+func newTestTableSet(t *testing.T) *tableSet {
+	t.Helper()
+
+	options := DefaultOptions()
+	set, err := openTableSet(t.TempDir(), options.Compaction, options.Logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { set.Close() })
+	return set
+}
+
+// Write the given entries to a new file of the given level of set,
+// Entries without a sequence number are numbered as the newest write
+func addTestSST(t *testing.T, set *tableSet, level int, entries []entry) *sstReader {
+	t.Helper()
+
+	path := set.newTableFile()
+	sst, err := newSSTFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Seq == 0 {
+			entry.Seq = set.lastSequence + 1
+		}
+		if err := sst.Add(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sst.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	sst.Close()
+
+	if level == 0 {
+		if err := set.add(path, sst.largestSeq); err != nil {
+			t.Fatal(err)
+		}
+		return set.levels[0][len(set.levels[0])-1]
+	}
+
+	reader, err := openSST(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.seq = sst.largestSeq
+	set.lastSequence = sst.largestSeq
+	if err := set.replace(nil, level, []*sstReader{reader}); err != nil {
+		t.Fatal(err)
+	}
+	return reader
+}
+
+// Entries of 100 keys where file i overwrites some keys and deletes others
+func overlappingEntries(i int) []entry {
+	var entries []entry
+	for k := 0; k < 100; k++ {
+		key := []byte(fmt.Sprintf("key%03d", k))
+		switch {
+		case k%10 == i:
+			entries = append(entries, entry{Kind: kindDelete, Key: key})
+		case k%4 == i%4:
+			entries = append(entries, entry{Kind: kindSet, Key: key, Value: []byte(fmt.Sprint(i))})
+		}
+	}
+	return entries
+}
+
+// What every key of overlappingEntries resolves to
+func resolveAll(t *testing.T, set *tableSet) map[string]entry {
+	t.Helper()
+
+	resolved := map[string]entry{}
+	for k := 0; k < 100; k++ {
+		key := fmt.Sprintf("key%03d", k)
+		entry, found, err := set.get([]byte(key), maxSequence)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found && !entry.IsDeleted() {
+			resolved[key] = entry
+		}
+	}
+	return resolved
+}
+
+func checkResolved(t *testing.T, set *tableSet, expected map[string]entry) {
+	t.Helper()
+
+	for key, entry := range resolveAll(t, set) {
+		if before, ok := expected[key]; !ok || !bytes.Equal(before.Value, entry.Value) {
+			t.Errorf("%s resolved to %q, expected %q", key, entry.Value, before.Value)
+		}
+	}
+	for key := range expected {
+		if _, found, _ := set.get([]byte(key), maxSequence); !found {
+			t.Errorf("%s is missing after the compaction", key)
+		}
+	}
+}
+
+func TestLeveledCompaction(t *testing.T) {
+	set := newTestTableSet(t)
+	for i := 0; i < set.options.L0Trigger; i++ {
+		addTestSST(t, set, 0, overlappingEntries(i))
+	}
+	inputs := append([]*sstReader{}, set.levels[0]...)
+	expected := resolveAll(t, set)
+
+	compacted, err := set.compact()
+	if err != nil || !compacted {
+		t.Fatalf("compact() = %v %v", compacted, err)
+	}
+
+	if len(set.levels[0]) != 0 || len(set.levels[1]) != 1 {
+		t.Fatalf("Expected the level 0 files to move to level 1, got %d and %d files", len(set.levels[0]), len(set.levels[1]))
+	}
+	for _, input := range inputs {
+		if _, err := os.Stat(input.file.Name()); !os.IsNotExist(err) {
+			t.Errorf("Input %s was not removed", input.file.Name())
+		}
+	}
+	checkResolved(t, set, expected)
+
+	// Nothing lives below level 1 so the tombstones are gone
+	it := set.levels[1][0].NewIterator()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if it.Entry().IsDeleted() {
+			t.Errorf("Tombstone of %s was kept", it.Entry().Key)
+		}
+	}
+
+	if compacted, _ := set.compact(); compacted {
+		t.Errorf("Nothing should be left to compact")
+	}
+}
+
+func TestLeveledCompactionKeepsTombstonesOverDeeperLevels(t *testing.T) {
+	set := newTestTableSet(t)
+	addTestSST(t, set, 2, []entry{{Kind: kindSet, Key: []byte("key000"), Value: []byte("old")}})
+	for i := 0; i < set.options.L0Trigger; i++ {
+		addTestSST(t, set, 0, overlappingEntries(i))
+	}
+	expected := resolveAll(t, set)
+
+	if _, err := set.compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	if entry, found, _ := set.get([]byte("key000"), maxSequence); !found || !entry.IsDeleted() {
+		t.Errorf("The tombstone of key000 should still hide the value of level 2")
+	}
+	checkResolved(t, set, expected)
+}
+
+func TestLeveledCompactionSplitsOutputs(t *testing.T) {
+	set := newTestTableSet(t)
+	set.options.TargetFileSize = 8 * 1024
+	set.options.BaseLevelSize = 16 * 1024
+	for i := 0; i < set.options.L0Trigger; i++ {
+		var entries []entry
+		for k := i; k < 4000; k += 4 {
+			entries = append(entries, entry{Kind: kindSet, Key: []byte(fmt.Sprintf("key%05d", k)), Value: []byte("value")})
+		}
+		addTestSST(t, set, 0, entries)
+	}
+
+	for {
+		compacted, err := set.compact()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !compacted {
+			break
+		}
+	}
+
+	if len(set.levels[0]) != 0 || len(set.levels[1]) == 0 || len(set.levels[2]) == 0 {
+		t.Fatalf("Expected files to be pushed down to level 2, got %d %d %d", len(set.levels[0]), len(set.levels[1]), len(set.levels[2]))
+	}
+	if size := set.levelSize(1); size > set.options.levelTargetSize(1) {
+		t.Errorf("Level 1 holds %d bytes, over its target", size)
+	}
+
+	for level := 1; level < numLevels; level++ {
+		files := append([]*sstReader{}, set.levels[level]...)
+		sort.Slice(files, func(i, j int) bool {
+			return bytes.Compare(files[i].smallestKey, files[j].smallestKey) < 0
+		})
+		for i := 1; i < len(files); i++ {
+			if bytes.Compare(files[i-1].largestKey, files[i].smallestKey) >= 0 {
+				t.Errorf("Files of level %d overlap", level)
+			}
+		}
+	}
+
+	for k := 0; k < 4000; k++ {
+		if _, found, err := set.get([]byte(fmt.Sprintf("key%05d", k)), maxSequence); err != nil || !found {
+			t.Fatalf("key%05d is missing: %v", k, err)
+		}
+	}
+}
+
+func TestCompactionKeepsHighestSequence(t *testing.T) {
+	set := newTestTableSet(t)
+	addTestSST(t, set, 0, []entry{
+		{Kind: kindSet, Seq: 5, Key: []byte("a"), Value: []byte("old")},
+		{Kind: kindSet, Seq: 6, Key: []byte("b"), Value: []byte("new")},
+	})
+	addTestSST(t, set, 0, []entry{
+		{Kind: kindSet, Seq: 10, Key: []byte("a"), Value: []byte("new")},
+		{Kind: kindSet, Seq: 1, Key: []byte("b"), Value: []byte("old")},
+	})
+
+	c := &compaction{outputLevel: 1, inputs: newestFirst(set.levels[0]), isBaseLevel: func([]byte) bool { return true }}
+	outputs, err := set.runCompaction(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := set.install(c, outputs); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"a", "b"} {
+		if entry, _, _ := set.get([]byte(key), maxSequence); string(entry.Value) != "new" {
+			t.Errorf("%s resolved to %q after the compaction", key, entry.Value)
+		}
+	}
+}
+
+func TestSizeTieredCompaction(t *testing.T) {
+	set := newTestTableSet(t)
+	set.options.Strategy = SizeTieredCompaction
+	addTestSST(t, set, 0, testEntries(2000))
+	for i := 0; i < set.options.MinMergeWidth; i++ {
+		addTestSST(t, set, 0, overlappingEntries(i))
+	}
+	oldest := set.levels[0][0]
+	expected := resolveAll(t, set)
+
+	compacted, err := set.compact()
+	if err != nil || !compacted {
+		t.Fatalf("compact() = %v %v", compacted, err)
+	}
+
+	if len(set.levels[0]) != 2 || set.levels[0][0] != oldest {
+		t.Fatalf("Expected the small files to be merged next to the big one, got %d files", len(set.levels[0]))
+	}
+	checkResolved(t, set, expected)
+
+	// The big file is older so the tombstones must stay
+	if entry, found, _ := set.get([]byte("key001"), maxSequence); !found || !entry.IsDeleted() {
+		t.Errorf("The tombstone of key001 should have been kept")
+	}
+}
+
+func TestLevelTargetSize(t *testing.T) {
+	options := CompactionOptions{BaseLevelSize: 100, LevelSizeMultipliers: []float64{2, 5}}
+
+	for level, expected := range map[int]int64{1: 100, 2: 200, 3: 1000, 4: 5000} {
+		if size := options.levelTargetSize(level); size != expected {
+			t.Errorf("Target size of level %d is %d, expected %d", level, size, expected)
+		}
+	}
+}
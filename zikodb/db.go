@@ -0,0 +1,352 @@
+package zikodb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotFound = errors.New("zikodb: key not found")
+
+	// Returned when the key was deleted, it also matches ErrNotFound
+	ErrDeleted = fmt.Errorf("%w: the key is deleted", ErrNotFound)
+
+	ErrClosed = errors.New("zikodb: database is closed")
+)
+
+// DB is a key-value store living in a directory, the wal is kept in
+// Its wal subdirectory and the sst files in its sst subdirectory. A DB
+// Is safe for concurrent use
+type DB struct {
+	options  Options
+	memtable *memtable
+	wal      *wal
+	tables   *tableSet
+
+	// Operations hold it shared, Close takes it exclusively
+	mu        sync.RWMutex
+	closed    bool
+	closing   chan struct{}
+	closeOnce sync.Once
+
+	background sync.WaitGroup
+}
+
+// Open the database stored in dir, creating it when it does not exist.
+// A nil options uses the default options
+func Open(dir string, options *Options) (*DB, error) {
+	opts := Options{}
+	if options != nil {
+		opts = *options
+	}
+	opts.setDefaults()
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	walDir := filepath.Join(dir, "wal")
+	sstDir := filepath.Join(dir, "sst")
+	for _, d := range []string{walDir, sstDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	tables, err := openTableSet(sstDir, opts.Compaction, opts.Logger)
+	if err != nil {
+		return nil, err
+	}
+	tables.bloomBitsPerKey = max(opts.BloomBitsPerKey, 0)
+	if err := tables.integrityCheck(); err != nil {
+		tables.Close()
+		return nil, err
+	}
+
+	wal, err := openWAL(walDir)
+	if err != nil {
+		tables.Close()
+		return nil, err
+	}
+	wal.syncMode = opts.Sync
+	if opts.PrefixDelimiter != "" {
+		tables.prefixDelimiter = []byte(opts.PrefixDelimiter)
+	}
+
+	// Writes are numbered after everything that reached the sst files,
+	// The wal replay then moves past the writes it holds
+	closing := make(chan struct{})
+	memtable := newMemtable(&opts, tables)
+	memtable.closing = closing
+	memtable.advanceSequence(tables.lastSequence)
+	if err := wal.flushWAL(memtable); err != nil {
+		wal.Close()
+		tables.Close()
+		return nil, err
+	}
+
+	db := &DB{
+		options:  opts,
+		memtable: memtable,
+		wal:      wal,
+		tables:   tables,
+		closing:  closing,
+	}
+
+	db.background.Add(1)
+	go db.periodicFlush()
+	if opts.Sync == SyncPeriodic {
+		db.background.Add(1)
+		go db.periodicSync()
+	}
+	if opts.ScrubInterval > 0 {
+		db.background.Add(1)
+		go db.periodicScrub()
+	}
+	if !opts.disableCompaction {
+		db.background.Add(1)
+		go func() {
+			defer db.background.Done()
+			tables.backgroundCompaction(db.closing)
+		}()
+	}
+
+	return db, nil
+}
+
+// Get the value of key. ErrNotFound is returned when the key was never
+// Set and ErrDeleted when its last write was a delete. Reads that need a
+// File found corrupt by the scrubber fail with ErrCorruptSST
+func (db *DB) Get(key []byte) ([]byte, error) {
+	return db.get(key, maxSequence)
+}
+
+// Get the value of key among the writes numbered up to seq, or among
+// The visible writes with maxSequence. The sequence is pinned for the
+// Read so that compactions keep the version it sees
+func (db *DB) get(key []byte, seq uint64) ([]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return nil, ErrClosed
+	}
+
+	if seq == maxSequence {
+		seq = db.memtable.pinSequence()
+		defer db.memtable.snapshots.remove(seq)
+	}
+
+	entry, found := db.memtable.get(key, seq)
+	if !found {
+		var err error
+		if entry, found, err = db.tables.get(key, seq); err != nil {
+			return nil, err
+		}
+	}
+
+	if !found {
+		return nil, ErrNotFound
+	}
+	if entry.IsDeleted() {
+		return nil, ErrDeleted
+	}
+	return entry.Value, nil
+}
+
+// Iterate over the live keys in [start, end) in key order, a nil start
+// Or end leaves that side of the range open. The iterator sees the
+// Database as it was when it was created, even across flushes and
+// Compactions. It must be closed
+func (db *DB) NewIterator(start, end []byte) (*Iterator, error) {
+	return db.newIterator(start, end, nil, maxSequence)
+}
+
+// Iterate over the live keys starting with prefix in key order. With a
+// PrefixDelimiter, a prefix ending with it skips the sst files whose
+// Prefix filter shows they hold no such key
+func (db *DB) NewPrefixIterator(prefix []byte) (*Iterator, error) {
+	return db.newIterator(prefix, prefixEnd(prefix), prefix, maxSequence)
+}
+
+// The smallest key greater than every key starting with prefix, nil
+// When there is none
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// Iterate at the sequence number seq, or at the visible writes with
+// maxSequence. Every iterator pins its sequence number until closed
+func (db *DB) newIterator(start, end []byte, prefix []byte, seq uint64) (*Iterator, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return nil, ErrClosed
+	}
+
+	if seq == maxSequence {
+		seq = db.memtable.pinSequence()
+	} else {
+		db.memtable.snapshots.add(seq)
+	}
+
+	// The memtable is looked at before the sst files, a flush happening
+	// In between then leaves its entries in both rather than in neither
+	iters := db.memtable.iterators()
+	tables, files := db.tables.iterators(start, end, prefix)
+
+	// Every source holds several versions of a key, only the newest one
+	// The iterator can see is kept
+	visible := make([]entryIterator, 0, len(iters)+len(tables))
+	for _, it := range append(iters, tables...) {
+		visible = append(visible, &visibleIterator{iter: it, seq: seq})
+	}
+
+	it := &Iterator{
+		merged:    newMergingIterator(visible),
+		files:     files,
+		start:     start,
+		end:       end,
+		seq:       seq,
+		snapshots: db.memtable.snapshots,
+	}
+	it.Seek(start)
+	return it, nil
+}
+
+// Set key to value, the write is in the wal once this returns and
+// Synced to disk as well with SyncAlways
+func (db *DB) Put(key []byte, value []byte) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+	return db.memtable.Set(key, value)
+}
+
+// Delete key, the write is in the wal once this returns and synced
+// To disk as well with SyncAlways
+func (db *DB) Delete(key []byte) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+	return db.memtable.Del(key)
+}
+
+// Statistics of the database
+type Stats struct {
+	Memtable MemtableStats `json:"memtable"`
+	WAL      WALStats      `json:"wal"`
+	Scrub    ScrubStats    `json:"scrub"`
+	SSTFiles []SSTStats    `json:"sst_files"`
+}
+
+// Writes are group committed, so there are usually fewer syncs than
+// Writes when many clients write at once
+type WALStats struct {
+	Writes uint64 `json:"writes"`
+	Syncs  uint64 `json:"syncs"`
+}
+
+// Sizes are approximate numbers of bytes, keys, values and bookkeeping
+// Included. The immutable memtable is the one being written to disk
+type MemtableStats struct {
+	Size          int64 `json:"size"`
+	Entries       int   `json:"entries"`
+	ImmutableSize int64 `json:"immutable_size"`
+}
+
+func (db *DB) Stats() Stats {
+	size, immutableSize := db.memtable.Size()
+	return Stats{
+		Memtable: MemtableStats{
+			Size:          size,
+			Entries:       db.memtable.Len(),
+			ImmutableSize: immutableSize,
+		},
+		WAL: WALStats{
+			Writes: db.wal.writes.Load(),
+			Syncs:  db.wal.syncs.Load(),
+		},
+		Scrub:    db.tables.ScrubStats(),
+		SSTFiles: db.tables.Stats(),
+	}
+}
+
+// Stop the background work and close the files. The memtable is not
+// Written to disk, its entries are replayed from the wal on the next Open.
+// A flush of a frozen memtable that keeps failing is given up, its error
+// Is returned and its entries are replayed from the wal as well
+func (db *DB) Close() error {
+	// Signal the closing before taking the lock, a writer waiting for a
+	// Failing flush to make room only lets go of it once the flush gives up
+	db.closeOnce.Do(func() { close(db.closing) })
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+	db.closed = true
+
+	db.background.Wait()
+	err := db.memtable.waitForFlush()
+
+	if walErr := db.wal.Close(); err == nil {
+		err = walErr
+	}
+	if tablesErr := db.tables.Close(); err == nil {
+		err = tablesErr
+	}
+	return err
+}
+
+// Periodically flush memtable to disk
+func (db *DB) periodicFlush() {
+	defer db.background.Done()
+
+	for {
+		select {
+		case <-time.After(db.options.FlushInterval):
+			db.memtable.freeze(true)
+		case <-db.closing:
+			return
+		}
+	}
+}
+
+// Periodically sync the wal when writes do not wait for it
+func (db *DB) periodicSync() {
+	defer db.background.Done()
+
+	ticker := time.NewTicker(db.options.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := db.wal.Sync(); err != nil {
+				db.options.Logger.Println("Error syncing WAL:", err)
+			}
+		case <-db.closing:
+			return
+		}
+	}
+}
@@ -0,0 +1,376 @@
+package zikodb
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func openTestDB(t *testing.T, dir string, options *Options) *DB {
+	t.Helper()
+
+	db, err := Open(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestDBPutGetDelete(t *testing.T) {
+	db := openTestDB(t, t.TempDir(), nil)
+
+	if _, err := db.Get([]byte("a")); !errors.Is(err, ErrNotFound) || errors.Is(err, ErrDeleted) {
+		t.Errorf("Get(a) on an empty database returned %v", err)
+	}
+
+	db.Put([]byte("a"), []byte("1"))
+	if value, err := db.Get([]byte("a")); err != nil || string(value) != "1" {
+		t.Errorf("Get(a) = %q %v", value, err)
+	}
+
+	db.Delete([]byte("a"))
+	if _, err := db.Get([]byte("a")); !errors.Is(err, ErrDeleted) || !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get(a) after Delete returned %v", err)
+	}
+}
+
+func TestDBReopen(t *testing.T) {
+	dir := t.TempDir()
+	options := &Options{MemtableEntries: 100}
+
+	db, err := Open(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 250; i++ {
+		db.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprint(i)))
+	}
+	db.Delete([]byte("key007"))
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("a"), []byte("1")); err != ErrClosed {
+		t.Errorf("Put after Close returned %v", err)
+	}
+
+	// The last entries only live in the wal
+	db = openTestDB(t, dir, options)
+	for i := 0; i < 250; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		value, err := db.Get([]byte(key))
+		if i == 7 {
+			if !errors.Is(err, ErrDeleted) {
+				t.Errorf("Get(%s) = %q %v, expected it to be deleted", key, value, err)
+			}
+			continue
+		}
+		if err != nil || string(value) != fmt.Sprint(i) {
+			t.Errorf("Get(%s) = %q %v", key, value, err)
+		}
+	}
+}
+
+func TestOpenRejectsUnknownOptions(t *testing.T) {
+	if _, err := Open(t.TempDir(), &Options{Sync: "sometimes"}); err == nil {
+		t.Errorf("expected an error for an unknown sync mode")
+	}
+	if _, err := Open(t.TempDir(), &Options{Compaction: CompactionOptions{Strategy: "random"}}); err == nil {
+		t.Errorf("expected an error for an unknown compaction strategy")
+	}
+	if _, err := Open(t.TempDir(), &Options{BloomBitsPerKey: 1000}); err == nil {
+		t.Errorf("expected an error for too many bloom bits per key")
+	}
+}
+
+// A flush that cannot write its sst file must not keep Close, nor the
+// Writer waiting for the flush, blocked forever
+func TestDBCloseGivesUpFailingFlush(t *testing.T) {
+	dir := t.TempDir()
+	options := &Options{MemtableEntries: 2}
+	db, err := Open(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(filepath.Join(dir, "sst"))
+
+	// The second memtable fills up while the first one cannot be flushed
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		for _, key := range []string{"a", "b", "c", "d"} {
+			db.Put([]byte(key), []byte("1"))
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	closed := make(chan error, 1)
+	go func() { closed <- db.Close() }()
+	select {
+	case err := <-closed:
+		if err == nil {
+			t.Errorf("Close should return the error of the failed flush")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close is blocked by the failing flush")
+	}
+	<-written
+
+	// The entries of the memtable that was not flushed are in the wal
+	db = openTestDB(t, dir, options)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if value, err := db.Get([]byte(key)); err != nil || string(value) != "1" {
+			t.Errorf("Get(%s) after reopening = %q %v", key, value, err)
+		}
+	}
+}
+
+func TestDBBloomBitsPerKey(t *testing.T) {
+	for bitsPerKey, expected := range map[int]int{0: 10 * 100 / 8, 20: 20 * 100 / 8, -1: 0} {
+		db := openTestDB(t, t.TempDir(), &Options{BloomBitsPerKey: bitsPerKey})
+		for i := 0; i < 100; i++ {
+			db.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("1"))
+		}
+		db.memtable.freeze(true)
+		db.memtable.waitForFlush()
+
+		size := 0
+		if filter := db.tables.levels[0][0].filter; filter != nil {
+			size = len(filter.bits)
+		}
+		if size < expected || size > expected+8 {
+			t.Errorf("With %d bits per key the filter takes %d bytes, expected about %d", bitsPerKey, size, expected)
+		}
+	}
+}
+
+func TestDBStatsMemtableSize(t *testing.T) {
+	db := openTestDB(t, t.TempDir(), nil)
+	db.Put([]byte("a"), make([]byte, 1000))
+
+	stats := db.Stats()
+	if stats.Memtable.Entries != 1 || stats.Memtable.Size < 1000 {
+		t.Errorf("Memtable stats = %+v", stats.Memtable)
+	}
+}
+
+// Collect the keys and values returned by an iterator over [start, end)
+func scan(t *testing.T, db *DB, start, end []byte) string {
+	t.Helper()
+
+	it, err := db.NewIterator(start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+
+	var result string
+	for ; it.Valid(); it.Next() {
+		result += fmt.Sprintf("%s=%s ", it.Key(), it.Value())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestDBIterator(t *testing.T) {
+	db := openTestDB(t, t.TempDir(), nil)
+
+	// Older versions of the keys end up in sst files, newer ones and
+	// The tombstones stay in the memtable
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		db.Put([]byte(key), []byte("old"))
+	}
+	db.memtable.freeze(true)
+	db.memtable.waitForFlush()
+	db.Put([]byte("b"), []byte("new"))
+	db.Delete([]byte("c"))
+	db.Put([]byte("f"), []byte("new"))
+	db.Delete([]byte("g"))
+
+	if got := scan(t, db, nil, nil); got != "a=old b=new d=old e=old f=new " {
+		t.Errorf("Full scan returned %q", got)
+	}
+	if got := scan(t, db, []byte("bb"), []byte("e")); got != "d=old " {
+		t.Errorf("Scan of [bb, e) returned %q", got)
+	}
+	if got := scan(t, db, []byte("b"), []byte("b")); got != "" {
+		t.Errorf("Scan of an empty range returned %q", got)
+	}
+}
+
+func TestDBIteratorOutlivesCompaction(t *testing.T) {
+	db := openTestDB(t, t.TempDir(), &Options{disableCompaction: true})
+	for i := 0; i < 100; i++ {
+		db.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("1"))
+	}
+	db.memtable.freeze(true)
+	db.memtable.waitForFlush()
+
+	it, err := db.NewIterator(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+
+	// Compact the file being read away from under the iterator
+	db.tables.mu.RLock()
+	inputs := append([]*sstReader{}, db.tables.levels[0]...)
+	db.tables.mu.RUnlock()
+	c := &compaction{level: 0, outputLevel: 1, inputs: inputs, isBaseLevel: func([]byte) bool { return true }}
+	outputs, err := db.tables.runCompaction(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.tables.install(c, outputs); err != nil {
+		t.Fatal(err)
+	}
+
+	count := 0
+	for ; it.Valid(); it.Next() {
+		count++
+	}
+	if err := it.Err(); err != nil || count != 100 {
+		t.Errorf("Iterated over %d keys with error %v, expected 100", count, err)
+	}
+	if err := it.Close(); err != nil {
+		t.Errorf("Close returned %v", err)
+	}
+	if _, err := os.Stat(inputs[0].file.Name()); !os.IsNotExist(err) {
+		t.Errorf("The compacted file should be removed once the iterator is closed")
+	}
+}
+
+func TestDBPrefixIterator(t *testing.T) {
+	db := openTestDB(t, t.TempDir(), &Options{PrefixDelimiter: ":"})
+	for _, key := range []string{"user:1:name", "user:1:profile", "user:10:name", "user:2:name"} {
+		db.Put([]byte(key), []byte("v"))
+	}
+	db.memtable.freeze(true)
+	db.memtable.waitForFlush()
+	db.Delete([]byte("user:1:name"))
+
+	it, err := db.NewPrefixIterator([]byte("user:1:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for ; it.Valid(); it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	it.Close()
+	if fmt.Sprint(keys) != "[user:1:profile]" {
+		t.Errorf("Prefix scan of user:1: returned %v", keys)
+	}
+
+	// The key range of the sst file covers the prefix, only its filter
+	// Shows it holds no key of the prefix
+	if it, _ = db.NewPrefixIterator([]byte("user:15:")); it.Valid() {
+		t.Errorf("Prefix scan of user:15: returned %s", it.Key())
+	}
+	it.Close()
+	if stats := db.Stats().SSTFiles; len(stats) != 1 || stats[0].PrefixFilterSkips != 1 {
+		t.Errorf("Expected the prefix filter to skip the sst file, got %+v", stats)
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	for prefix, expected := range map[string]string{"ab": "ac", "a\xff": "b", "\xff\xff": "", "": ""} {
+		if end := prefixEnd([]byte(prefix)); string(end) != expected {
+			t.Errorf("prefixEnd(%q) = %q, expected %q", prefix, end, expected)
+		}
+	}
+}
+
+// Walk a random mix of Next and Prev over keys spread across sst files
+// And the memtable, and compare with a plain map
+func TestDBIteratorDirections(t *testing.T) {
+	db := openTestDB(t, t.TempDir(), nil)
+	rnd := rand.New(rand.NewSource(1))
+
+	live := map[string]string{}
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 200; i++ {
+			key := fmt.Sprintf("key%03d", rnd.Intn(300))
+			if rnd.Intn(4) == 0 {
+				db.Delete([]byte(key))
+				delete(live, key)
+			} else {
+				value := fmt.Sprint(round, i)
+				db.Put([]byte(key), []byte(value))
+				live[key] = value
+			}
+		}
+		if round < 2 {
+			db.memtable.freeze(true)
+			db.memtable.waitForFlush()
+		}
+	}
+
+	var keys []string
+	for key := range live {
+		if key >= "key050" && key < "key250" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	it, err := db.NewIterator([]byte("key050"), []byte("key250"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+
+	it.SeekToLast()
+	pos := len(keys) - 1
+	for step := 0; step < 2000; step++ {
+		if pos < 0 || pos >= len(keys) {
+			if it.Valid() {
+				t.Fatalf("Step %d: expected the end of the range, got %s", step, it.Key())
+			}
+			pos = rnd.Intn(len(keys))
+			it.Seek([]byte(keys[pos]))
+		}
+		if !it.Valid() || string(it.Key()) != keys[pos] || string(it.Value()) != live[keys[pos]] {
+			t.Fatalf("Step %d: expected %s=%s, iterator valid %v", step, keys[pos], live[keys[pos]], it.Valid())
+		}
+		if rnd.Intn(2) == 0 {
+			it.Next()
+			pos++
+		} else {
+			it.Prev()
+			pos--
+		}
+	}
+
+	it.SeekForPrev([]byte("key150a"))
+	expected := sort.SearchStrings(keys, "key150a") - 1
+	if !it.Valid() || string(it.Key()) != keys[expected] {
+		t.Errorf("SeekForPrev(key150a) should land on %s", keys[expected])
+	}
+}
+
+// The empty key sorts first, the key range of the sst file must still
+// Start with it
+func TestDBEmptyKeyAfterFlush(t *testing.T) {
+	db := openTestDB(t, t.TempDir(), nil)
+	db.Put(nil, []byte("1"))
+	db.Put([]byte("a"), []byte("2"))
+	db.memtable.freeze(true)
+	db.memtable.waitForFlush()
+
+	for _, key := range [][]byte{nil, {}} {
+		if value, err := db.Get(key); err != nil || string(value) != "1" {
+			t.Errorf("Get(%q) = %q %v", key, value, err)
+		}
+	}
+	if got := scan(t, db, nil, nil); got != "=1 a=2 " {
+		t.Errorf("Full scan returned %q", got)
+	}
+}
@@ -0,0 +1,375 @@
+package zikodb
+
+import "bytes"
+
+// Common shape of the memtable and sst iterators
+type entryIterator interface {
+	SeekToFirst()
+	SeekToLast()
+	Seek(key []byte)
+	Valid() bool
+	Next()
+	Prev()
+	Entry() entry
+	Err() error
+}
+
+func (it *skipListIterator) Err() error {
+	return nil
+}
+
+// Position it on the last entry whose key is <= key
+func seekForPrev(it entryIterator, key []byte) {
+	it.Seek(key)
+	if it.Err() != nil {
+		return
+	}
+	if !it.Valid() {
+		it.SeekToLast()
+	} else if bytes.Compare(it.Entry().Key, key) > 0 {
+		it.Prev()
+	}
+}
+
+// Shows only the newest version of every key among the ones numbered up
+// To seq. The versions of a key follow each other from the newest to the
+// Oldest, so the newest visible one is the first with a small enough
+// Sequence number going forward, and the last one going backward
+type visibleIterator struct {
+	iter entryIterator
+	seq  uint64
+}
+
+func (v *visibleIterator) SeekToFirst() {
+	v.iter.SeekToFirst()
+	v.skipForward()
+}
+
+func (v *visibleIterator) SeekToLast() {
+	v.iter.SeekToLast()
+	v.skipBackward()
+}
+
+func (v *visibleIterator) Seek(key []byte) {
+	v.iter.Seek(key)
+	v.skipForward()
+}
+
+func (v *visibleIterator) Valid() bool {
+	return v.iter.Valid()
+}
+
+func (v *visibleIterator) Next() {
+	key := v.iter.Entry().Key
+	for v.iter.Valid() && bytes.Equal(v.iter.Entry().Key, key) {
+		v.iter.Next()
+	}
+	v.skipForward()
+}
+
+func (v *visibleIterator) Prev() {
+	key := v.iter.Entry().Key
+	for v.iter.Valid() && bytes.Equal(v.iter.Entry().Key, key) {
+		v.iter.Prev()
+	}
+	v.skipBackward()
+}
+
+func (v *visibleIterator) Entry() entry {
+	return v.iter.Entry()
+}
+
+func (v *visibleIterator) Err() error {
+	return v.iter.Err()
+}
+
+func (v *visibleIterator) skipForward() {
+	for v.iter.Valid() && v.iter.Entry().Seq > v.seq {
+		v.iter.Next()
+	}
+}
+
+// Move back to the oldest visible version of a key, then step back over
+// The newer visible versions of the same key
+func (v *visibleIterator) skipBackward() {
+	for v.iter.Valid() && v.iter.Entry().Seq > v.seq {
+		v.iter.Prev()
+	}
+	if !v.iter.Valid() {
+		return
+	}
+
+	key := v.iter.Entry().Key
+	for {
+		v.iter.Prev()
+		if !v.iter.Valid() {
+			if v.iter.Err() == nil {
+				v.iter.SeekToFirst()
+			}
+			return
+		}
+		if entry := v.iter.Entry(); !bytes.Equal(entry.Key, key) || entry.Seq > v.seq {
+			v.iter.Next()
+			return
+		}
+	}
+}
+
+// Merges several sorted iterators into one. When several of them hold
+// The same key only the entry with the highest sequence number is
+// Returned. The iterators are given from the newest source to the
+// Oldest one, which breaks ties between entries without sequence number.
+// Going forward the other iterators sit after the current key, going
+// Backward before it, so they are moved over when the direction changes
+type mergingIterator struct {
+	iters   []entryIterator
+	current int
+	reverse bool
+
+	// Return every version of the keys going forward, from the newest
+	// To the oldest, instead of only the newest one
+	allVersions bool
+}
+
+func newMergingIterator(iters []entryIterator) *mergingIterator {
+	return &mergingIterator{iters: iters, current: -1}
+}
+
+func (m *mergingIterator) SeekToFirst() {
+	for _, it := range m.iters {
+		it.SeekToFirst()
+	}
+	m.reverse = false
+	m.findCurrent()
+}
+
+func (m *mergingIterator) SeekToLast() {
+	for _, it := range m.iters {
+		it.SeekToLast()
+	}
+	m.reverse = true
+	m.findCurrent()
+}
+
+// Position every iterator on the first entry whose key is >= key
+func (m *mergingIterator) Seek(key []byte) {
+	for _, it := range m.iters {
+		it.Seek(key)
+	}
+	m.reverse = false
+	m.findCurrent()
+}
+
+// Position every iterator on the last entry whose key is <= key
+func (m *mergingIterator) SeekForPrev(key []byte) {
+	for _, it := range m.iters {
+		seekForPrev(it, key)
+	}
+	m.reverse = true
+	m.findCurrent()
+}
+
+// Point at the iterator holding the smallest key, or the largest one
+// Going backward. Among the ones holding that key the newest entry wins.
+// An iterator that failed ends the iteration, the keys it holds would
+// Be missing otherwise
+func (m *mergingIterator) findCurrent() {
+	m.current = -1
+	for _, it := range m.iters {
+		if it.Err() != nil {
+			return
+		}
+	}
+
+	for i, it := range m.iters {
+		if !it.Valid() {
+			continue
+		}
+		if m.current < 0 {
+			m.current = i
+			continue
+		}
+
+		entry, current := it.Entry(), m.iters[m.current].Entry()
+		c := bytes.Compare(entry.Key, current.Key)
+		if m.reverse {
+			c = -c
+		}
+		if c < 0 || (c == 0 && entry.Seq > current.Seq) {
+			m.current = i
+		}
+	}
+}
+
+func (m *mergingIterator) Valid() bool {
+	return m.current >= 0
+}
+
+// Move past the current key in every iterator, which skips
+// The older versions shadowed by the current entry
+func (m *mergingIterator) Next() {
+	if m.allVersions {
+		m.iters[m.current].Next()
+		m.findCurrent()
+		return
+	}
+
+	key := m.Entry().Key
+	for _, it := range m.iters {
+		if m.reverse && it.Err() == nil {
+			it.Seek(key)
+		}
+		for it.Valid() && bytes.Equal(it.Entry().Key, key) {
+			it.Next()
+		}
+	}
+	m.reverse = false
+	m.findCurrent()
+}
+
+// Move before the current key in every iterator
+func (m *mergingIterator) Prev() {
+	key := m.Entry().Key
+	for _, it := range m.iters {
+		if !m.reverse && it.Err() == nil {
+			seekForPrev(it, key)
+		}
+		for it.Valid() && bytes.Equal(it.Entry().Key, key) {
+			it.Prev()
+		}
+	}
+	m.reverse = true
+	m.findCurrent()
+}
+
+func (m *mergingIterator) Entry() entry {
+	return m.iters[m.current].Entry()
+}
+
+func (m *mergingIterator) Err() error {
+	for _, it := range m.iters {
+		if err := it.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Iterator walks the live keys of a DB in key order or in reverse,
+// Deleted keys are skipped. It must be closed once done with, the sst
+// Files it reads stay on disk until then. The returned keys and values
+// Must not be modified
+type Iterator struct {
+	merged *mergingIterator
+	files  []*sstReader
+
+	// The keys returned are in [start, end), nil leaves that side open
+	start []byte
+	end   []byte
+
+	// The sequence number the iterator reads at, pinned until it is
+	// Closed so that compactions keep the versions it sees
+	seq       uint64
+	snapshots *snapshotList
+
+	closed bool
+}
+
+// Position the iterator on the first live key >= key, keys before the
+// Start of the range are skipped
+func (it *Iterator) Seek(key []byte) {
+	if bytes.Compare(key, it.start) < 0 {
+		key = it.start
+	}
+	if key == nil {
+		it.merged.SeekToFirst()
+	} else {
+		it.merged.Seek(key)
+	}
+	it.skipDeleted()
+}
+
+// Position the iterator on the last live key of the range
+func (it *Iterator) SeekToLast() {
+	if it.end == nil {
+		it.merged.SeekToLast()
+	} else {
+		it.merged.SeekForPrev(it.end)
+		if it.merged.Valid() && bytes.Equal(it.merged.Entry().Key, it.end) {
+			it.merged.Prev()
+		}
+	}
+	it.skipDeletedBackward()
+}
+
+// Position the iterator on the last live key <= key, keys past the end
+// Of the range are skipped
+func (it *Iterator) SeekForPrev(key []byte) {
+	if it.end != nil && bytes.Compare(key, it.end) >= 0 {
+		it.SeekToLast()
+		return
+	}
+	it.merged.SeekForPrev(key)
+	it.skipDeletedBackward()
+}
+
+func (it *Iterator) skipDeleted() {
+	for it.Valid() && it.merged.Entry().IsDeleted() {
+		it.merged.Next()
+	}
+}
+
+func (it *Iterator) skipDeletedBackward() {
+	for it.Valid() && it.merged.Entry().IsDeleted() {
+		it.merged.Prev()
+	}
+}
+
+func (it *Iterator) Valid() bool {
+	if it.closed || !it.merged.Valid() {
+		return false
+	}
+	key := it.merged.Entry().Key
+	return bytes.Compare(key, it.start) >= 0 && (it.end == nil || bytes.Compare(key, it.end) < 0)
+}
+
+func (it *Iterator) Next() {
+	it.merged.Next()
+	it.skipDeleted()
+}
+
+func (it *Iterator) Prev() {
+	it.merged.Prev()
+	it.skipDeletedBackward()
+}
+
+func (it *Iterator) Key() []byte {
+	return it.merged.Entry().Key
+}
+
+func (it *Iterator) Value() []byte {
+	return it.merged.Entry().Value
+}
+
+// The error that stopped the iteration early, a file found corrupt
+// For instance. Nil when every key of the range was returned
+func (it *Iterator) Err() error {
+	return it.merged.Err()
+}
+
+// Release the sst files read by the iterator
+func (it *Iterator) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	it.snapshots.remove(it.seq)
+
+	var err error
+	for _, sst := range it.files {
+		if unrefErr := sst.unref(); err == nil {
+			err = unrefErr
+		}
+	}
+	return err
+}
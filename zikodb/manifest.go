@@ -0,0 +1,309 @@
+package zikodb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const manifestName = "MANIFEST"
+
+// Tags of the fields of a version edit
+const (
+	tagNextFileNumber = byte(1)
+	tagAddFile        = byte(2)
+	tagDeleteFile     = byte(3)
+	tagLastSequence   = byte(4)
+)
+
+// What the manifest knows about a live sst file. The sequence number
+// Orders the files of level 0, a file with a higher sequence number
+// Holds newer data
+type fileMeta struct {
+	name     string
+	level    int
+	seq      uint64
+	size     int64
+	smallest []byte
+	largest  []byte
+}
+
+// A change to the set of live sst files, flushes add a file and
+// Compactions add their outputs and delete their inputs in one edit.
+// The last sequence number is the highest one written to an sst file
+type versionEdit struct {
+	nextFileNumber uint64
+	lastSequence   uint64
+	added          []fileMeta
+	deleted        []string
+}
+
+// The manifest is a log of version edits, replaying it from the start
+// Gives the set of live sst files. Each record is framed as
+//
+//	length u32 | crc32 u32 | edit
+//
+// And an edit is a list of tagged fields:
+//
+//	nextFileNumber: 1 u8 | number u64
+//	addFile:        2 u8 | nameLen u32 | name | level u8 | seq u64 | size u64 |
+//	                smallestLen u32 | smallest | largestLen u32 | largest
+//	deleteFile:     3 u8 | nameLen u32 | name
+//	lastSequence:   4 u8 | seq u64
+type manifest struct {
+	mu   sync.Mutex
+	file *os.File
+
+	// Bytes of the complete records, a failed edit is cut back to it.
+	// When that fails the manifest refuses every edit from then on
+	size   int64
+	failed error
+}
+
+func (e *versionEdit) encode() []byte {
+	var buf bytes.Buffer
+
+	if e.nextFileNumber > 0 {
+		buf.WriteByte(tagNextFileNumber)
+		binary.Write(&buf, binary.BigEndian, e.nextFileNumber)
+	}
+	if e.lastSequence > 0 {
+		buf.WriteByte(tagLastSequence)
+		binary.Write(&buf, binary.BigEndian, e.lastSequence)
+	}
+	for _, meta := range e.added {
+		buf.WriteByte(tagAddFile)
+		binary.Write(&buf, binary.BigEndian, uint32(len(meta.name)))
+		buf.WriteString(meta.name)
+		buf.WriteByte(byte(meta.level))
+		binary.Write(&buf, binary.BigEndian, meta.seq)
+		binary.Write(&buf, binary.BigEndian, uint64(meta.size))
+		binary.Write(&buf, binary.BigEndian, uint32(len(meta.smallest)))
+		buf.Write(meta.smallest)
+		binary.Write(&buf, binary.BigEndian, uint32(len(meta.largest)))
+		buf.Write(meta.largest)
+	}
+	for _, name := range e.deleted {
+		buf.WriteByte(tagDeleteFile)
+		binary.Write(&buf, binary.BigEndian, uint32(len(name)))
+		buf.WriteString(name)
+	}
+
+	return buf.Bytes()
+}
+
+func decodeVersionEdit(data []byte) (versionEdit, error) {
+	var edit versionEdit
+	reader := bytes.NewReader(data)
+	limit := int64(len(data))
+
+	readString := func() (string, error) {
+		var n uint32
+		if err := binary.Read(reader, binary.BigEndian, &n); err != nil {
+			return "", err
+		}
+		b, err := readBytes(reader, n, limit)
+		return string(b), err
+	}
+
+	for reader.Len() > 0 {
+		tag, _ := reader.ReadByte()
+		switch tag {
+		case tagNextFileNumber:
+			if err := binary.Read(reader, binary.BigEndian, &edit.nextFileNumber); err != nil {
+				return edit, err
+			}
+		case tagLastSequence:
+			if err := binary.Read(reader, binary.BigEndian, &edit.lastSequence); err != nil {
+				return edit, err
+			}
+		case tagAddFile:
+			var meta fileMeta
+			var level uint8
+			var size uint64
+			var n uint32
+			var err error
+			if meta.name, err = readString(); err != nil {
+				return edit, err
+			}
+			if err := binary.Read(reader, binary.BigEndian, &level); err != nil {
+				return edit, err
+			}
+			if err := binary.Read(reader, binary.BigEndian, &meta.seq); err != nil {
+				return edit, err
+			}
+			if err := binary.Read(reader, binary.BigEndian, &size); err != nil {
+				return edit, err
+			}
+			if err := binary.Read(reader, binary.BigEndian, &n); err != nil {
+				return edit, err
+			}
+			if meta.smallest, err = readBytes(reader, n, limit); err != nil {
+				return edit, err
+			}
+			if err := binary.Read(reader, binary.BigEndian, &n); err != nil {
+				return edit, err
+			}
+			if meta.largest, err = readBytes(reader, n, limit); err != nil {
+				return edit, err
+			}
+			if int(level) >= numLevels {
+				return edit, fmt.Errorf("invalid level %d for %s", level, meta.name)
+			}
+			meta.level = int(level)
+			meta.size = int64(size)
+			edit.added = append(edit.added, meta)
+		case tagDeleteFile:
+			name, err := readString()
+			if err != nil {
+				return edit, err
+			}
+			edit.deleted = append(edit.deleted, name)
+		default:
+			return edit, fmt.Errorf("unknown manifest tag %d", tag)
+		}
+	}
+
+	return edit, nil
+}
+
+// Replay the manifest of dir and return the live files along with the
+// Next file number and the last sequence number. A record torn by a
+// Crash can only be the last one, replay stops there since the edit it
+// Carried never took effect
+func replayManifest(dir string, logger *log.Logger) (map[string]fileMeta, uint64, uint64, error) {
+	data, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	live := make(map[string]fileMeta)
+	var nextFileNumber, lastSequence uint64
+
+	for len(data) > 0 {
+		if len(data) < 8 {
+			break
+		}
+		length := binary.BigEndian.Uint32(data)
+		checksum := binary.BigEndian.Uint32(data[4:])
+		if uint64(len(data)-8) < uint64(length) {
+			break
+		}
+		record := data[8 : 8+length]
+		if crc32.ChecksumIEEE(record) != checksum {
+			break
+		}
+		data = data[8+length:]
+
+		edit, err := decodeVersionEdit(record)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		if edit.nextFileNumber > nextFileNumber {
+			nextFileNumber = edit.nextFileNumber
+		}
+		if edit.lastSequence > lastSequence {
+			lastSequence = edit.lastSequence
+		}
+		for _, name := range edit.deleted {
+			delete(live, name)
+		}
+		for _, meta := range edit.added {
+			live[meta.name] = meta
+		}
+	}
+
+	if len(data) > 0 {
+		logger.Printf("Ignoring %d bytes of torn manifest record\n", len(data))
+	}
+
+	return live, nextFileNumber, lastSequence, nil
+}
+
+// Write a manifest holding a single edit that describes the current
+// Set of files, replacing the existing one. The new manifest is
+// Written aside and renamed so that there always is a complete one
+func createManifest(dir string, snapshot versionEdit) (*manifest, error) {
+	path := filepath.Join(dir, manifestName)
+	tmp := path + ".tmp"
+
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &manifest{file: file}
+	if err := m.apply(snapshot); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := syncDir(dir); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Append an edit and wait for it to reach the disk, the edit is only
+// Part of the database once this returns. A failed edit is cut off so
+// That the edits after it are not lost behind a torn record
+func (m *manifest) apply(edit versionEdit) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.failed != nil {
+		return m.failed
+	}
+
+	payload := edit.encode()
+	record := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(record, uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(payload))
+	record = append(record, payload...)
+
+	if _, err := m.file.Write(record); err != nil {
+		return m.rollback(err)
+	}
+	if err := m.file.Sync(); err != nil {
+		return m.rollback(err)
+	}
+	m.size += int64(len(record))
+	return nil
+}
+
+// Cut off what a failed edit may have left in the manifest, the caller
+// Must hold the lock
+func (m *manifest) rollback(err error) error {
+	if truncateErr := m.file.Truncate(m.size); truncateErr != nil {
+		m.failed = fmt.Errorf("manifest failed after %v: %w", err, truncateErr)
+	}
+	return err
+}
+
+func (m *manifest) Close() error {
+	return m.file.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package zikodb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Open the directory of set again, as a restart would
+func reopenTableSet(t *testing.T, set *tableSet) *tableSet {
+	t.Helper()
+
+	set.Close()
+	reopened, err := openTableSet(set.dir, set.options, set.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { reopened.Close() })
+	return reopened
+}
+
+func levelNames(set *tableSet) [numLevels][]string {
+	var names [numLevels][]string
+	for level, files := range set.levels {
+		for _, sst := range files {
+			names[level] = append(names[level], filepath.Base(sst.file.Name()))
+		}
+	}
+	return names
+}
+
+func TestManifestReplay(t *testing.T) {
+	set := newTestTableSet(t)
+	for i := 0; i < set.options.L0Trigger; i++ {
+		addTestSST(t, set, 0, overlappingEntries(i))
+	}
+	if _, err := set.compact(); err != nil {
+		t.Fatal(err)
+	}
+	addTestSST(t, set, 0, overlappingEntries(7))
+	expected := resolveAll(t, set)
+
+	reopened := reopenTableSet(t, set)
+	if fmt.Sprint(levelNames(reopened)) != fmt.Sprint(levelNames(set)) {
+		t.Errorf("Reopened levels %v, expected %v", levelNames(reopened), levelNames(set))
+	}
+	checkResolved(t, reopened, expected)
+
+	if reopened.lastSequence != set.lastSequence {
+		t.Errorf("Reopened last sequence is %d, expected %d", reopened.lastSequence, set.lastSequence)
+	}
+	if name := reopened.newTableFile(); name <= reopened.levels[0][0].file.Name() {
+		t.Errorf("File number of %s was already used", name)
+	}
+}
+
+func TestManifestRemovesUnknownFiles(t *testing.T) {
+	set := newTestTableSet(t)
+	addTestSST(t, set, 0, overlappingEntries(1))
+
+	// What a crash in the middle of a flush leaves behind
+	stray := set.newTableFile()
+	os.WriteFile(stray, []byte("half written"), 0644)
+
+	reopened := reopenTableSet(t, set)
+	if _, err := os.Stat(stray); !os.IsNotExist(err) {
+		t.Errorf("%s should have been removed", stray)
+	}
+	if len(reopened.levels[0]) != 1 {
+		t.Errorf("Expected a single live file, got %d", len(reopened.levels[0]))
+	}
+}
+
+func TestManifestIgnoresTornRecord(t *testing.T) {
+	set := newTestTableSet(t)
+	addTestSST(t, set, 0, overlappingEntries(1))
+
+	manifest, _ := os.OpenFile(filepath.Join(set.dir, manifestName), os.O_APPEND|os.O_WRONLY, 0644)
+	manifest.Write([]byte{0, 0, 1, 0, 1, 2, 3, 4, tagAddFile})
+	manifest.Close()
+
+	reopened := reopenTableSet(t, set)
+	if len(reopened.levels[0]) != 1 {
+		t.Errorf("Expected a single live file, got %d", len(reopened.levels[0]))
+	}
+}
+
+func TestManifestRollsBackFailedEdit(t *testing.T) {
+	set := newTestTableSet(t)
+	addTestSST(t, set, 0, overlappingEntries(1))
+
+	// A write that stopped half way through a record
+	set.manifest.file.Write([]byte{0, 0, 1, 0, 1, 2, 3, 4, tagAddFile})
+	set.manifest.rollback(errors.New("no space left on device"))
+	addTestSST(t, set, 0, overlappingEntries(2))
+
+	reopened := reopenTableSet(t, set)
+	if len(reopened.levels[0]) != 2 {
+		t.Errorf("Expected the files added before and after the failed edit, got %d", len(reopened.levels[0]))
+	}
+}
+
+// When the torn bytes cannot be cut off, no edit succeeds anymore
+func TestManifestFailsWhenRollbackFails(t *testing.T) {
+	set := newTestTableSet(t)
+
+	// Neither written nor truncated through a read only file
+	file := set.manifest.file
+	var err error
+	if set.manifest.file, err = os.Open(filepath.Join(set.dir, manifestName)); err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := set.manifest.apply(versionEdit{nextFileNumber: 9}); err == nil {
+			t.Errorf("Edit %d on a failed manifest succeeded", i)
+		}
+	}
+	if set.manifest.failed == nil {
+		t.Errorf("The manifest should be failed once it cannot be cut back")
+	}
+}
+
+func TestManifestImportsLegacyDirectory(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"20240101000000.000000001.sst", "20240101000000.000000002.sst"} {
+		os.WriteFile(filepath.Join(dir, name), writeTestSSTBytes(t, overlappingEntries(len(name)%4)), 0644)
+	}
+
+	options := DefaultOptions()
+	set, err := openTableSet(dir, options.Compaction, options.Logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer set.Close()
+
+	names := levelNames(set)
+	if len(names[0]) != 2 || names[0][0] != "20240101000000.000000001.sst" {
+		t.Errorf("Unexpected levels after import: %v", names)
+	}
+	if _, err := os.Stat(filepath.Join(dir, manifestName)); err != nil {
+		t.Errorf("The manifest was not written: %v", err)
+	}
+}
+
+// Encode entries as the bytes of an sst file
+func writeTestSSTBytes(t *testing.T, entries []entry) []byte {
+	t.Helper()
+
+	reader := writeTestSST(t, entries)
+	data, err := os.ReadFile(reader.file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestLoadRemovesTemporaryFiles(t *testing.T) {
+	set := newTestTableSet(t)
+	addTestSST(t, set, 0, overlappingEntries(0))
+
+	leftover := filepath.Join(set.dir, "000009.sst"+tempFileSuffix)
+	os.WriteFile(leftover, []byte("half written"), 0644)
+
+	set = reopenTableSet(t, set)
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Errorf("The temporary file should be removed on startup")
+	}
+	if len(set.levels[0]) != 1 {
+		t.Errorf("Expected the live file to be kept, got %d files", len(set.levels[0]))
+	}
+}
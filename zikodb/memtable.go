@@ -0,0 +1,354 @@
+package zikodb
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The kind of an entry, the same bytes are used as opcodes
+// In the wal and in the sst files
+type entryKind byte
+
+const (
+	kindSet    entryKind = 'S'
+	kindDelete entryKind = 'D'
+)
+
+// A single key in the memtable, deletions are kept inline
+// As tombstones so that they shadow older values on disk.
+// When two entries share a key the one with the highest
+// Sequence number wins, entries of version 1 sst files
+// Predate sequence numbers and carry 0
+type entry struct {
+	Kind  entryKind
+	Seq   uint64
+	Key   []byte
+	Value []byte
+}
+
+func (e entry) IsDeleted() bool {
+	return e.Kind == kindDelete
+}
+
+// The memtable receives the writes in its active skiplist. Once full
+// The skiplist is frozen as the immutable memtable and a fresh one takes
+// Its place, then a background goroutine writes the frozen one to an
+// Sst file. Only one memtable can be frozen at a time, writes that fill
+// The active one before the previous flush is done wait for it
+type memtable struct {
+	// Writes hold it shared while they number, log and insert an entry,
+	// So that freezing the memtable never separates an entry from its wal
+	mu sync.RWMutex
+
+	data      *skipList
+	immutable *skipList
+
+	// The wal segment holding the entries of the immutable memtable
+	immutableSegment uint64
+
+	// Closed once the immutable memtable is written to disk
+	flushed chan struct{}
+
+	// A flush that keeps failing is retried until the database closes,
+	// It then gives up and leaves the entries in the wal for the next
+	// Open. Nothing is frozen from then on
+	closing  <-chan struct{}
+	flushErr error
+
+	// Writes are logged to the wal before reaching the memtable,
+	// Nil while the wal is being replayed
+	wal *wal
+
+	// Last sequence number handed out, every write takes the next one
+	// So that the order of the writes does not depend on the clock or
+	// On the order in which they reach the memtable
+	lastSequence atomic.Uint64
+
+	// Last sequence number reads see. It moves forward once every write
+	// Numbered up to it is in the memtable, so a batch is seen whole or
+	// Not at all even by reads that do not take the lock
+	visibleSequence atomic.Uint64
+	publishMu       sync.Mutex
+	published       *sync.Cond
+
+	// Where frozen memtables are written
+	tables *tableSet
+	logger *log.Logger
+
+	// The live snapshots, shared with the table set
+	snapshots *snapshotList
+
+	// The memtable is frozen when it reaches either limit,
+	// A zero entryLimit means only the size counts
+	sizeLimit  int64
+	entryLimit int
+
+	// Refuse to replay a wal that ends with a corrupt record
+	strictRecovery bool
+}
+
+func newMemtable(options *Options, tables *tableSet) *memtable {
+	m := &memtable{
+		tables:     tables,
+		logger:     options.Logger,
+		sizeLimit:  options.MemtableSize,
+		entryLimit: options.MemtableEntries,
+
+		strictRecovery: options.StrictWALRecovery,
+	}
+	if tables != nil {
+		m.snapshots = tables.snapshots
+	} else {
+		m.snapshots = &snapshotList{}
+	}
+	m.published = sync.NewCond(&m.publishMu)
+	m.data = newSkipList()
+	return m
+}
+
+// Register a reader of the writes made visible so far and return its
+// Sequence number, it must be removed from the snapshots once done
+func (m *memtable) pinSequence() uint64 {
+	return m.snapshots.pin(&m.visibleSequence)
+}
+
+// Make the writes numbered from first to last visible, once the writes
+// Numbered before them are
+func (m *memtable) publish(first, last uint64) {
+	m.publishMu.Lock()
+	defer m.publishMu.Unlock()
+
+	for m.visibleSequence.Load() != first-1 {
+		m.published.Wait()
+	}
+	m.visibleSequence.Store(last)
+	m.published.Broadcast()
+}
+
+func (m *memtable) nextSequence() uint64 {
+	return m.lastSequence.Add(1)
+}
+
+// Make sure sequence numbers handed out from now on are above seq
+func (m *memtable) advanceSequence(seq uint64) {
+	for {
+		last := m.lastSequence.Load()
+		if last >= seq || m.lastSequence.CompareAndSwap(last, seq) {
+			return
+		}
+	}
+}
+
+func (m *memtable) Set(key []byte, value []byte) error {
+
+	return m.put(entry{Kind: kindSet, Key: key, Value: value})
+}
+
+// Get the newest entry of key numbered up to seq, the returned entry can
+// Be a tombstone in which case the key was deleted and older values must
+// Be ignored. The active and the immutable memtable are both looked at
+func (m *memtable) get(key []byte, seq uint64) (entry, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	entry, found := m.data.get(key, seq)
+	if m.immutable != nil {
+		if frozen, ok := m.immutable.get(key, seq); ok && (!found || frozen.Seq > entry.Seq) {
+			return frozen, true
+		}
+	}
+	return entry, found
+}
+
+// Replace the value of key with a tombstone
+func (m *memtable) Del(key []byte) error {
+
+	return m.put(entry{Kind: kindDelete, Key: key})
+}
+
+// Number the entries, log them to the wal, insert them then publish
+// Them. The memtable is frozen when the entries fill it up. The sequence
+// Numbers are taken under the lock so that a write always lands in a
+// Newer memtable than the writes numbered before it, and a frozen
+// Memtable only holds published writes. Entries written together are
+// Logged as a single record and published at once, so reads see all of
+// Them or none
+func (m *memtable) put(entries ...entry) error {
+	m.mu.RLock()
+
+	first := m.lastSequence.Add(uint64(len(entries))) - uint64(len(entries)) + 1
+	last := first + uint64(len(entries)) - 1
+	for i := range entries {
+		entries[i].Seq = first + uint64(i)
+	}
+
+	if m.wal != nil {
+		walEntries := make([]walEntry, len(entries))
+		for i, entry := range entries {
+			walEntries[i] = walEntry{
+				Action: byte(entry.Kind),
+				Seq:    entry.Seq,
+				Key:    entry.Key,
+				Value:  entry.Value,
+			}
+		}
+		if err := m.wal.WriteBatch(walEntries); err != nil {
+			// Nothing was inserted, the numbers are skipped
+			m.publish(first, last)
+			m.mu.RUnlock()
+			return err
+		}
+	}
+
+	for _, entry := range entries {
+		m.data.Put(entry)
+	}
+	m.publish(first, last)
+	full := m.isFull(m.data)
+	m.mu.RUnlock()
+
+	if full {
+		m.freeze(false)
+	}
+	return nil
+}
+
+func (m *memtable) isFull(data *skipList) bool {
+	if data.Size() >= m.sizeLimit {
+		return true
+	}
+	return m.entryLimit > 0 && data.Len() >= m.entryLimit
+}
+
+// Freeze the active memtable if it is full, or as soon as it holds an
+// Entry when force is set, and start writing it in the background. The
+// Wal is rotated along so that the wal of the frozen memtable can be
+// Removed once it is on disk
+func (m *memtable) freeze(force bool) {
+	for {
+		m.mu.Lock()
+		if m.immutable == nil || m.flushErr != nil {
+			break
+		}
+		flushed := m.flushed
+		m.mu.Unlock()
+		<-flushed
+	}
+	defer m.mu.Unlock()
+
+	// Another writer may have frozen it while we waited
+	if m.flushErr != nil || m.data.Len() == 0 || !force && !m.isFull(m.data) {
+		return
+	}
+
+	if m.wal != nil {
+		segment, err := m.wal.rotate()
+		if err != nil {
+			m.logger.Println("Error rotating WAL:", err)
+			return
+		}
+		m.immutableSegment = segment
+	}
+
+	m.immutable = m.data
+	m.data = newSkipList()
+	m.flushed = make(chan struct{})
+	go m.flushImmutable()
+}
+
+// Write the immutable memtable to an sst file then drop it along
+// With its wal. Failed writes are retried since writers may be
+// Waiting for the memtable to make room, until the database closes
+func (m *memtable) flushImmutable() {
+	for {
+		err := m.tables.writeSST(m.immutable)
+		if err == nil {
+			break
+		}
+		m.logger.Println("Error flushing memtable to new SST file:", err)
+
+		select {
+		case <-time.After(flushRetryDelay):
+		case <-m.closing:
+			// The immutable memtable stays readable and its wal
+			// Segment stays on disk to be replayed
+			m.mu.Lock()
+			defer m.mu.Unlock()
+
+			m.flushErr = err
+			close(m.flushed)
+			return
+		}
+	}
+
+	if m.wal != nil {
+		if err := m.wal.removeSegments(m.immutableSegment); err != nil {
+			m.logger.Println("Error removing WAL segments:", err)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.immutable = nil
+	close(m.flushed)
+}
+
+// Wait until the frozen memtable, if any, is written to disk or the
+// Flush gave up, in which case its error is returned
+func (m *memtable) waitForFlush() error {
+	m.mu.RLock()
+	flushed := m.flushed
+	m.mu.RUnlock()
+
+	if flushed != nil {
+		<-flushed
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.flushErr
+}
+
+// Number of entries of the active memtable, tombstones included
+func (m *memtable) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.data.Len()
+}
+
+// Approximate number of bytes used by the active and the immutable memtable
+func (m *memtable) Size() (active int64, immutable int64) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.immutable != nil {
+		immutable = m.immutable.Size()
+	}
+	return m.data.Size(), immutable
+}
+
+// Iterators over the active and the immutable memtable, newest first.
+// A skiplist can still be iterated once the memtable moved past it
+func (m *memtable) iterators() []entryIterator {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	iters := []entryIterator{m.data.NewIterator()}
+	if m.immutable != nil {
+		iters = append(iters, m.immutable.NewIterator())
+	}
+	return iters
+}
+
+// Clear the memtable data and its tombstones
+func (m *memtable) Clear() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.data = newSkipList()
+}
@@ -0,0 +1,183 @@
+package zikodb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSet(t *testing.T) {
+	memtable := newMemtable(DefaultOptions(), nil)
+	memtable.Set([]byte("1"), []byte("1"))
+	if entry, ok := memtable.data.get([]byte("1"), maxSequence); !ok || string(entry.Value) != "1" {
+		t.Errorf("Set(1, 1) did not correctly set the data")
+	}
+}
+
+func TestGet(t *testing.T) {
+	memtable := newMemtable(DefaultOptions(), nil)
+	memtable.Set([]byte("1"), []byte("1"))
+	if entry, _ := memtable.get([]byte("1"), maxSequence); string(entry.Value) != "1" {
+		t.Errorf("Get(1) did not get the correct data")
+	}
+}
+
+func TestDel(t *testing.T) {
+	memtable := newMemtable(DefaultOptions(), nil)
+	memtable.Set([]byte("1"), []byte("1"))
+	memtable.Del([]byte("1"))
+	entry, ok := memtable.get([]byte("1"), maxSequence)
+	if !ok || !entry.IsDeleted() || entry.Value != nil {
+		t.Errorf("Del(1) did not leave a tombstone")
+	}
+	if memtable.Len() != 2 {
+		t.Errorf("Del(1) should keep the value as an older version, got %d entries", memtable.Len())
+	}
+}
+
+func TestSetAfterDel(t *testing.T) {
+	memtable := newMemtable(DefaultOptions(), nil)
+	memtable.Del([]byte("1"))
+	memtable.Set([]byte("1"), []byte("2"))
+	if entry, _ := memtable.get([]byte("1"), maxSequence); entry.IsDeleted() || string(entry.Value) != "2" {
+		t.Errorf("Set(1, 2) did not replace the tombstone")
+	}
+}
+
+func TestIteratorOrder(t *testing.T) {
+	memtable := newMemtable(DefaultOptions(), nil)
+	for _, k := range []string{"b", "d", "a", "c", "e"} {
+		memtable.Set([]byte(k), []byte(k))
+	}
+	memtable.Del([]byte("c"))
+
+	// Both versions of c are kept, the tombstone first
+	var keys string
+	it := memtable.data.NewIterator()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		keys += string(it.Entry().Key)
+	}
+	if keys != "abccde" {
+		t.Errorf("Iterator returned %q, expected \"abccde\"", keys)
+	}
+
+	it.Seek([]byte("bb"))
+	if !it.Valid() || string(it.Entry().Key) != "c" || !it.Entry().IsDeleted() {
+		t.Errorf("Seek(bb) should land on the tombstone of c")
+	}
+}
+
+func TestClear(t *testing.T) {
+	memtable := newMemtable(DefaultOptions(), nil)
+	memtable.Set([]byte("1"), []byte("1"))
+	memtable.Clear()
+	if memtable.Len() != 0 {
+		t.Errorf("Memtable didn't get cleared")
+	}
+}
+
+func TestOlderWriteDoesNotReplaceNewer(t *testing.T) {
+	memtable := newMemtable(DefaultOptions(), nil)
+	memtable.data.Put(entry{Kind: kindSet, Seq: 5, Key: []byte("1"), Value: []byte("new")})
+	memtable.data.Put(entry{Kind: kindDelete, Seq: 3, Key: []byte("1")})
+	if entry, _ := memtable.get([]byte("1"), maxSequence); entry.IsDeleted() || string(entry.Value) != "new" || entry.Seq != 5 {
+		t.Errorf("The write with sequence number 3 replaced the one with 5")
+	}
+}
+
+func TestFrozenMemtableIsReadable(t *testing.T) {
+	memtable := newMemtable(DefaultOptions(), nil)
+	memtable.Set([]byte("1"), []byte("old"))
+	memtable.Set([]byte("2"), []byte("2"))
+	memtable.immutable, memtable.data = memtable.data, newSkipList()
+	memtable.Set([]byte("1"), []byte("new"))
+
+	if entry, _ := memtable.get([]byte("1"), maxSequence); string(entry.Value) != "new" {
+		t.Errorf("Get(1) returned %q, expected the value of the active memtable", entry.Value)
+	}
+	if entry, ok := memtable.get([]byte("2"), maxSequence); !ok || string(entry.Value) != "2" {
+		t.Errorf("Get(2) did not find the value of the immutable memtable")
+	}
+}
+
+func TestFreezeFlushesInBackground(t *testing.T) {
+	tables := newTestTableSet(t)
+
+	dir := t.TempDir()
+	wal, err := newWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	memtable := newMemtable(DefaultOptions(), tables)
+	memtable.wal = wal
+	for i := 1; i <= 10; i++ {
+		memtable.Set([]byte(fmt.Sprint(i)), []byte("value"))
+	}
+	memtable.freeze(true)
+	memtable.waitForFlush()
+
+	if memtable.immutable != nil || memtable.Len() != 0 {
+		t.Errorf("The memtable should be empty after its flush")
+	}
+	if _, err := os.Stat(filepath.Join(dir, walSegmentName(1))); !os.IsNotExist(err) {
+		t.Errorf("The segment of the frozen memtable should be removed after the flush")
+	}
+	if len(tables.levels[0]) != 1 || tables.lastSequence != memtable.lastSequence.Load() {
+		t.Fatalf("Expected one sst file holding the last sequence number")
+	}
+
+	memtable.Set([]byte("11"), []byte("value"))
+	if entries, _ := readWAL(filepath.Join(dir, walSegmentName(2))); len(entries) != 1 || entries[0].Seq != memtable.lastSequence.Load() {
+		t.Errorf("Only the writes after the freeze should be in the wal, got %d entries", len(entries))
+	}
+}
+
+func TestMemtableSize(t *testing.T) {
+	memtable := newMemtable(DefaultOptions(), nil)
+	memtable.Set([]byte("key"), []byte("value"))
+	size, _ := memtable.Size()
+	if size < int64(len("key")+len("value")) {
+		t.Fatalf("Size() = %d, smaller than the key and the value", size)
+	}
+
+	// A new value of the key is a new version, the old one still counts
+	memtable.Set([]byte("key"), []byte("longer value"))
+	if grown, _ := memtable.Size(); grown-size < int64(len("key")+len("longer value")) {
+		t.Errorf("Size() grew from %d to %d", size, grown)
+	}
+}
+
+func TestFreezeOnSizeOrEntries(t *testing.T) {
+	// Ten one-byte values fit in the budget, a single large one does not
+	options := &Options{MemtableSize: 4096}
+	options.setDefaults()
+	memtable := newMemtable(options, newTestTableSet(t))
+
+	for i := 0; i < 10; i++ {
+		memtable.Set([]byte(fmt.Sprint(i)), []byte("x"))
+	}
+	memtable.waitForFlush()
+	if memtable.Len() != 10 {
+		t.Errorf("Small values should not fill the memtable, got %d entries", memtable.Len())
+	}
+
+	memtable.Set([]byte("large"), make([]byte, 4096))
+	memtable.waitForFlush()
+	if memtable.Len() != 0 {
+		t.Errorf("A value larger than the budget should freeze the memtable, got %d entries", memtable.Len())
+	}
+
+	// The entry limit freezes the memtable before the size does
+	options.MemtableEntries = 5
+	memtable = newMemtable(options, newTestTableSet(t))
+	for i := 0; i < 5; i++ {
+		memtable.Set([]byte(fmt.Sprint(i)), []byte("x"))
+	}
+	memtable.waitForFlush()
+	if memtable.Len() != 0 {
+		t.Errorf("Reaching MemtableEntries should freeze the memtable, got %d entries", memtable.Len())
+	}
+}
@@ -0,0 +1,150 @@
+package zikodb
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+const (
+	defaultMemtableSize  = 4 * 1024 * 1024
+	defaultFlushInterval = time.Second * 60
+	defaultSyncInterval  = time.Millisecond * 100
+	defaultScrubInterval = time.Hour * 24
+	defaultScrubRate     = 8 * 1024 * 1024
+
+	// Bits of bloom filter per key, around 1% of false positives.
+	// More bits buy little past the maximum
+	defaultBloomBitsPerKey = 10
+	maxBloomBitsPerKey     = 64
+)
+
+// When the wal is synced to stable storage
+type SyncMode string
+
+const (
+	// Leave it to the operating system, a crash of the machine can
+	// Lose the last writes but a crash of the process cannot
+	SyncNone SyncMode = "none"
+
+	// Sync the wal before every write returns. Concurrent writes are
+	// Synced together so they share the cost of a single fsync
+	SyncAlways SyncMode = "always"
+
+	// Sync the wal every SyncInterval, writes return without waiting
+	// For it so a crash of the machine loses at most the last interval
+	SyncPeriodic SyncMode = "periodic"
+)
+
+// Options of a database, fields left to their zero value get the
+// Default value
+type Options struct {
+	// Approximate number of bytes, keys, values and bookkeeping
+	// Included, after which the memtable is frozen and written to a
+	// New sst file
+	MemtableSize int64
+
+	// Number of entries after which the memtable is frozen even when
+	// It is under MemtableSize, zero means no limit
+	MemtableEntries int
+
+	// How often the memtable is written to disk even when not full
+	FlushInterval time.Duration
+
+	Sync SyncMode
+
+	// How often the wal is synced with SyncPeriodic
+	SyncInterval time.Duration
+
+	// Recovery normally replays the wal up to its first torn or corrupt
+	// Record and drops the rest. When set, Open fails with an error
+	// Matching ErrCorruptWAL instead and the wal is left untouched
+	StrictWALRecovery bool
+
+	Compaction CompactionOptions
+
+	// How often the checksums of the sst files are verified in the
+	// Background, a negative interval turns the scrubber off
+	ScrubInterval time.Duration
+
+	// Bytes per second the scrubber reads at most
+	ScrubRate int64
+
+	// Keys are grouped by their prefixes ending with this delimiter,
+	// "user:" and "user:123:" for the key "user:123:profile" with ":".
+	// Sst files then get a bloom filter over these prefixes so that
+	// Prefix scans skip the files holding no key of the prefix. Empty
+	// Means no prefix filter
+	PrefixDelimiter string
+
+	// Bits of bloom filter per key of the sst files written from now
+	// On, more bits mean fewer reads of files that do not hold the key.
+	// Zero means the default and a negative value writes no filter
+	BloomBitsPerKey int
+
+	// Where background errors and progress are reported,
+	// Nothing is reported when nil
+	Logger *log.Logger
+
+	// Tests that run compactions by hand turn the background
+	// Compactions off so that both never pick the same files
+	disableCompaction bool
+}
+
+func DefaultOptions() *Options {
+	options := &Options{}
+	options.setDefaults()
+	return options
+}
+
+func (o *Options) setDefaults() {
+	if o.MemtableSize <= 0 {
+		o.MemtableSize = defaultMemtableSize
+	}
+	if o.MemtableEntries < 0 {
+		o.MemtableEntries = 0
+	}
+	if o.FlushInterval <= 0 {
+		o.FlushInterval = defaultFlushInterval
+	}
+	if o.Sync == "" {
+		o.Sync = SyncNone
+	}
+	if o.SyncInterval <= 0 {
+		o.SyncInterval = defaultSyncInterval
+	}
+	if o.ScrubInterval == 0 {
+		o.ScrubInterval = defaultScrubInterval
+	}
+	if o.ScrubRate <= 0 {
+		o.ScrubRate = defaultScrubRate
+	}
+	if o.BloomBitsPerKey == 0 {
+		o.BloomBitsPerKey = defaultBloomBitsPerKey
+	}
+	if o.Logger == nil {
+		o.Logger = log.New(io.Discard, "", 0)
+	}
+	o.Compaction.setDefaults()
+}
+
+// Reject the values that have no default to fall back to
+func (o *Options) validate() error {
+	switch o.Sync {
+	case SyncNone, SyncAlways, SyncPeriodic:
+	default:
+		return fmt.Errorf("zikodb: unknown sync mode %q", o.Sync)
+	}
+
+	if o.BloomBitsPerKey > maxBloomBitsPerKey {
+		return fmt.Errorf("zikodb: at most %d bloom bits per key, got %d", maxBloomBitsPerKey, o.BloomBitsPerKey)
+	}
+
+	switch o.Compaction.Strategy {
+	case LeveledCompaction, SizeTieredCompaction:
+	default:
+		return fmt.Errorf("zikodb: unknown compaction strategy %q", o.Compaction.Strategy)
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package zikodb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Size of the header of version 2 sst files, the first data
+// Block starts right after it
+const sstHeaderSize = 18
+
+// What Repair could read from a single file
+type RepairedFile struct {
+	Name string `json:"name"`
+
+	// Entries salvaged and bytes that could not be decoded
+	Entries   int   `json:"entries"`
+	LostBytes int64 `json:"lost_bytes"`
+
+	// Why nothing at all could be read from the file
+	Error string `json:"error,omitempty"`
+}
+
+type RepairReport struct {
+	Files []RepairedFile `json:"files"`
+
+	// Keys written to the new database, deleted keys are left out
+	Keys int `json:"keys"`
+}
+
+// Bytes that could not be decoded across every file
+func (r *RepairReport) LostBytes() int64 {
+	var lost int64
+	for _, file := range r.Files {
+		lost += file.LostBytes
+	}
+	return lost
+}
+
+// Salvage every record that can still be decoded from the sst and wal
+// Files of the database in dir, the quarantined files included, into a
+// Fresh database created in outDir. The files of dir are only read and
+// The manifest is ignored, so Repair also works when it is damaged.
+// When two records share a key the one with the highest sequence number
+// Wins, records without one are ordered by the files holding them
+func Repair(dir string, outDir string, options *Options) (*RepairReport, error) {
+	if names, err := os.ReadDir(outDir); err == nil && len(names) > 0 {
+		return nil, fmt.Errorf("zikodb: %s is not empty", outDir)
+	}
+
+	sstDir := filepath.Join(dir, "sst")
+	var sstFiles []string
+	for _, pattern := range []string{filepath.Join(sstDir, "*.sst"), filepath.Join(sstDir, quarantineDir, "*.sst")} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		sstFiles = append(sstFiles, matches...)
+	}
+
+	// File numbers grow with time, the older files go first
+	sort.SliceStable(sstFiles, func(i, j int) bool {
+		return filepath.Base(sstFiles[i]) < filepath.Base(sstFiles[j])
+	})
+
+	walFiles, _, err := walSegments(filepath.Join(dir, "wal"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	report := &RepairReport{}
+	merged := newSkipList()
+
+	for _, filename := range sstFiles {
+		entries, repaired := salvageSST(filename)
+		for _, entry := range entries {
+			merged.Put(entry)
+		}
+		report.Files = append(report.Files, repaired)
+	}
+
+	for _, filename := range walFiles {
+		entries, repaired := salvageWAL(filename)
+		for _, record := range entries {
+			kind := entryKind(record.Action)
+			if kind == kindDelete {
+				record.Value = nil
+			}
+			merged.Put(entry{Kind: kind, Seq: record.Seq, Key: record.Key, Value: record.Value})
+		}
+		report.Files = append(report.Files, repaired)
+	}
+
+	// Only the newest version of each key is kept, the versions of a key
+	// Come from the newest to the oldest. Nothing older is left for a
+	// Tombstone to hide, so deleted keys are dropped altogether
+	live := newSkipList()
+	var previous []byte
+	first := true
+	it := merged.NewIterator()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		entry := it.Entry()
+		if !first && bytes.Equal(entry.Key, previous) {
+			continue
+		}
+		previous, first = entry.Key, false
+		if !entry.IsDeleted() {
+			live.Put(entry)
+		}
+	}
+	report.Keys = live.Len()
+
+	db, err := Open(outDir, options)
+	if err != nil {
+		return nil, err
+	}
+	if live.Len() > 0 {
+		if err := db.tables.writeSST(live); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return report, db.Close()
+}
+
+// Read the blocks of an sst file that pass their checksum. Files whose
+// Index cannot be read are scanned block after block from the start
+func salvageSST(filename string) ([]entry, RepairedFile) {
+	repaired := RepairedFile{Name: filename}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		repaired.Error = err.Error()
+		return nil, repaired
+	}
+
+	var entries []entry
+	reader, err := openSST(filename)
+	if err == nil {
+		defer reader.Close()
+
+		var salvaged int64
+		for i, handle := range reader.index {
+			blockEntries, err := reader.readBlock(i)
+			if err != nil {
+				continue
+			}
+			entries = append(entries, blockEntries...)
+			salvaged += int64(handle.size) + 4
+		}
+
+		// Version 1 files have no per block checksum, their single
+		// Block is all there is
+		if reader.version != legacyVersion {
+			repaired.LostBytes = blocksSize(reader.index) - salvaged
+		}
+	} else {
+		if len(data) < sstHeaderSize || binary.BigEndian.Uint32(data) != magicNumber {
+			repaired.Error = err.Error()
+			repaired.LostBytes = int64(len(data))
+			return nil, repaired
+		}
+
+		if binary.BigEndian.Uint16(data[sstHeaderSize-2:]) != version {
+			repaired.Error = err.Error()
+			repaired.LostBytes = int64(len(data))
+			return nil, repaired
+		}
+
+		var covered int
+		entries, covered = scanBlocks(data[sstHeaderSize:])
+		repaired.LostBytes = int64(len(data) - sstHeaderSize - covered)
+	}
+
+	repaired.Entries = len(entries)
+	return entries, repaired
+}
+
+func blocksSize(index []blockHandle) int64 {
+	var size int64
+	for _, handle := range index {
+		size += int64(handle.size) + 4
+	}
+	return size
+}
+
+// Decode data blocks one after the other without an index. The end of a
+// Block is found where the checksum of the entries decoded so far follows
+// Them, only the entries of blocks whose checksum matches are returned.
+// The scan stops at the first entry that cannot be decoded, covered is
+// The number of bytes of the blocks returned
+func scanBlocks(data []byte) ([]entry, int) {
+	var entries, pending []entry
+	start, offset, covered := 0, 0, 0
+
+	for offset < len(data) {
+		if offset > start && offset+4 <= len(data) &&
+			sstChecksum(data[start:offset]) == binary.BigEndian.Uint32(data[offset:]) {
+			entries = append(entries, pending...)
+			pending = nil
+			offset += 4
+			covered += offset - start
+			start = offset
+			continue
+		}
+
+		entry, rest, ok := decodeEntry(data[offset:], true, true)
+		if !ok {
+			break
+		}
+		pending = append(pending, entry)
+		offset = len(data) - len(rest)
+	}
+
+	return entries, covered
+}
+
+// Read the records of a wal file. Past a corrupt record, the scan looks
+// For the next record whose frame and checksum are valid
+func salvageWAL(filename string) ([]walEntry, RepairedFile) {
+	repaired := RepairedFile{Name: filename}
+
+	entries, err := readWAL(filename)
+	var corruption *walCorruptionError
+	if err != nil && !errors.As(err, &corruption) {
+		repaired.Error = err.Error()
+		return nil, repaired
+	}
+
+	if corruption != nil {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			repaired.Error = err.Error()
+			return nil, repaired
+		}
+
+		offset := int(corruption.Offset)
+		for offset < len(data) {
+			if data[offset] == walFramedRecord || data[offset] == walBatchRecord {
+				if record, n, reason := decodeWALRecord(data[offset:]); reason == "" {
+					entries = append(entries, record...)
+					offset += n
+					continue
+				}
+			}
+			repaired.LostBytes++
+			offset++
+		}
+	}
+
+	repaired.Entries = len(entries)
+	return entries, repaired
+}
@@ -0,0 +1,151 @@
+package zikodb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Fill a database with 20 keys of 1000 bytes per sst file, the keys after
+// The last flush only live in the wal
+func writeRepairTestDB(t *testing.T, dir string, keys int) {
+	t.Helper()
+
+	db, err := Open(dir, &Options{MemtableEntries: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < keys; i++ {
+		db.Put([]byte(fmt.Sprintf("key%03d", i)), bytes.Repeat([]byte{byte('a' + i%26)}, 1000))
+	}
+	db.Delete([]byte("key000"))
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func flipByte(t *testing.T, filename string, offset int64) {
+	t.Helper()
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[offset] ^= 0xff
+	os.WriteFile(filename, data, 0644)
+}
+
+func TestOpenQuarantinesCorruptSST(t *testing.T) {
+	dir := t.TempDir()
+	writeRepairTestDB(t, dir, 40)
+
+	sstDir := filepath.Join(dir, "sst")
+	flipByte(t, filepath.Join(sstDir, "000001.sst"), 100)
+	os.WriteFile(filepath.Join(sstDir, "000002.sst"), []byte{1, 2}, 0644)
+
+	db := openTestDB(t, dir, nil)
+	for _, name := range []string{"000001.sst", "000002.sst"} {
+		if _, err := os.Stat(filepath.Join(sstDir, quarantineDir, name)); err != nil {
+			t.Errorf("%s should be quarantined: %v", name, err)
+		}
+	}
+	for _, file := range db.Stats().SSTFiles {
+		if file.File == "000001.sst" || file.File == "000002.sst" {
+			t.Errorf("The quarantined file %s should not be served", file.File)
+		}
+	}
+	if _, err := db.Get([]byte("key005")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get(key005) returned %v, expected it to be gone with its file", err)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	dir := t.TempDir()
+	writeRepairTestDB(t, dir, 50)
+
+	// Damage the second block of the first file, and a record in the
+	// Middle of the wal segment holding the last ten keys
+	flipByte(t, filepath.Join(dir, "sst", "000001.sst"), sstHeaderSize+blockSize+100)
+	segments, _, _ := walSegments(filepath.Join(dir, "wal"))
+	flipByte(t, segments[len(segments)-1], 1500)
+
+	// A file whose footer is gone is scanned block by block
+	second := filepath.Join(dir, "sst", "000002.sst")
+	data, _ := os.ReadFile(second)
+	os.WriteFile(second, data[:len(data)-30], 0644)
+
+	out := filepath.Join(t.TempDir(), "repaired")
+	report, err := Repair(dir, out, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.LostBytes() == 0 {
+		t.Errorf("Expected the damaged blocks and records to be reported as lost")
+	}
+
+	db := openTestDB(t, out, nil)
+	found := 0
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		value, err := db.Get([]byte(key))
+		if err != nil {
+			continue
+		}
+		found++
+		if !bytes.Equal(value, bytes.Repeat([]byte{byte('a' + i%26)}, 1000)) {
+			t.Errorf("Get(%s) returned a wrong value", key)
+		}
+	}
+	if _, err := db.Get([]byte("key000")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("key000 was deleted, got %v", err)
+	}
+	if found != report.Keys {
+		t.Errorf("Found %d keys, the report says %d", found, report.Keys)
+	}
+
+	// Only the keys of the damaged block and record are lost
+	if found < 40 || found >= 49 {
+		t.Errorf("Found %d of the 49 keys", found)
+	}
+
+	if _, err := Repair(dir, out, nil); err == nil {
+		t.Errorf("Repair should refuse a directory that is not empty")
+	}
+}
+
+// A key deleted after it was written stays deleted, and a key written
+// Twice is counted once
+func TestRepairKeepsNewestVersion(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put([]byte("k"), []byte("1"))
+	db.Delete([]byte("k"))
+	db.Put([]byte("j"), []byte("1"))
+	db.Put([]byte("j"), []byte("2"))
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	out := filepath.Join(t.TempDir(), "repaired")
+	report, err := Repair(dir, out, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Keys != 1 {
+		t.Errorf("Expected 1 key in the report, got %d", report.Keys)
+	}
+
+	repaired := openTestDB(t, out, nil)
+	if _, err := repaired.Get([]byte("k")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("k was deleted, got %v", err)
+	}
+	if value, err := repaired.Get([]byte("j")); err != nil || string(value) != "2" {
+		t.Errorf("Get(j) = %q %v, expected the newest value", value, err)
+	}
+}
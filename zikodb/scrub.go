@@ -0,0 +1,177 @@
+package zikodb
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"path/filepath"
+	"time"
+)
+
+// Largest read of the scrubber, smaller reads keep the rate smooth
+const scrubChunkSize = 64 * 1024
+
+var errScrubStopped = errors.New("scrub stopped")
+
+// Results of the background scrubber
+type ScrubStats struct {
+	// Complete passes over the live files
+	Runs uint64 `json:"runs"`
+
+	FilesChecked uint64 `json:"files_checked"`
+	BytesChecked uint64 `json:"bytes_checked"`
+
+	// Files found corrupt since the database was opened
+	CorruptFiles uint64 `json:"corrupt_files"`
+
+	// When the last complete pass ended
+	LastRun time.Time `json:"last_run"`
+}
+
+// Periodically verify the checksum of every live sst file
+func (db *DB) periodicScrub() {
+	defer db.background.Done()
+
+	for {
+		select {
+		case <-time.After(db.options.ScrubInterval):
+			db.tables.scrub(db.options.ScrubRate, db.closing)
+		case <-db.closing:
+			return
+		}
+	}
+}
+
+// Read every live sst file at no more than rate bytes per second and
+// Check it against its checksum. Corrupt files are marked so that reads
+// Of them fail, they are quarantined on the next start
+func (s *tableSet) scrub(rate int64, stop <-chan struct{}) {
+	// Every file stays open until it is checked, even when a compaction
+	// Replaces it in the meantime
+	s.mu.RLock()
+	var files []*sstReader
+	for _, level := range s.levels {
+		for _, sst := range level {
+			sst.ref()
+			files = append(files, sst)
+		}
+	}
+	s.mu.RUnlock()
+
+	limiter := &rateLimitedReader{rate: rate, start: time.Now(), stop: stop}
+	for i, sst := range files {
+		err := s.scrubFile(sst, limiter)
+		if err := sst.unref(); err != nil {
+			s.logger.Println("Scrub: error closing SST file:", err)
+		}
+		if err == errScrubStopped {
+			for _, sst := range files[i+1:] {
+				sst.unref()
+			}
+			return
+		}
+	}
+
+	s.scrubMu.Lock()
+	s.scrubStats.Runs++
+	s.scrubStats.LastRun = time.Now()
+	s.scrubMu.Unlock()
+}
+
+// Check a single file, the caller holds a reference to it. Files that
+// A compaction replaced are skipped, nothing reads them anymore
+func (s *tableSet) scrubFile(sst *sstReader, limiter *rateLimitedReader) error {
+	if sst.corruption() != nil || sst.obsolete.Load() {
+		return nil
+	}
+
+	limiter.reader = io.NewSectionReader(sst.file, 0, sst.size)
+	err := verifyChecksumStream(limiter, sst.size, sst.version)
+	name := filepath.Base(sst.file.Name())
+
+	switch {
+	case err == errScrubStopped:
+		return err
+	case sst.obsolete.Load():
+		// Compacted away while it was being read
+		return nil
+	case errors.Is(err, ErrCorruptSST):
+		s.logger.Printf("Scrub: SST file %s is corrupt: %v\n", name, err)
+		sst.markCorrupt(err)
+		s.scrubMu.Lock()
+		s.scrubStats.CorruptFiles++
+		s.scrubMu.Unlock()
+	case err != nil:
+		s.logger.Printf("Scrub: error reading SST file %s: %v\n", name, err)
+		return nil
+	}
+
+	s.scrubMu.Lock()
+	s.scrubStats.FilesChecked++
+	s.scrubStats.BytesChecked += uint64(sst.size)
+	s.scrubMu.Unlock()
+	return nil
+}
+
+func (s *tableSet) ScrubStats() ScrubStats {
+	s.scrubMu.Lock()
+	defer s.scrubMu.Unlock()
+
+	return s.scrubStats
+}
+
+// Hash the size bytes of a file read from reader and compare them with
+// The checksum that ends it, without holding the file in memory
+func verifyChecksumStream(reader io.Reader, size int64, fileVersion uint16) error {
+	if size < 4 {
+		return ErrCorruptSST
+	}
+
+	hash := newSSTHash(fileVersion)
+	if _, err := io.CopyN(hash, reader, size-4); err != nil {
+		if err == io.EOF {
+			return ErrCorruptSST
+		}
+		return err
+	}
+
+	stored := make([]byte, 4)
+	if _, err := io.ReadFull(reader, stored); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrCorruptSST
+		}
+		return err
+	}
+	if hash.Sum32() != binary.BigEndian.Uint32(stored) {
+		return errChecksumMismatch
+	}
+	return nil
+}
+
+// Reader that keeps the average rate of the reads since start under
+// Rate bytes per second, it gives up once stop is closed
+type rateLimitedReader struct {
+	reader io.Reader
+	rate   int64
+	start  time.Time
+	read   int64
+	stop   <-chan struct{}
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > scrubChunkSize {
+		p = p[:scrubChunkSize]
+	}
+	n, err := r.reader.Read(p)
+	r.read += int64(n)
+
+	wait := time.Duration(float64(r.read)/float64(r.rate)*float64(time.Second)) - time.Since(r.start)
+	if wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-r.stop:
+			return n, errScrubStopped
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,93 @@
+package zikodb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestScrubMarksCorruptFiles(t *testing.T) {
+	set := newTestTableSet(t)
+	good := addTestSST(t, set, 0, testEntries(100))
+	bad := addTestSST(t, set, 0, overlappingEntries(1))
+
+	// Damage the file in place, the reader keeps reading the same file
+	data, _ := os.ReadFile(bad.file.Name())
+	data[sstHeaderSize+10] ^= 0xff
+	os.WriteFile(bad.file.Name(), data, 0644)
+
+	set.scrub(1<<30, make(chan struct{}))
+
+	stats := set.ScrubStats()
+	if stats.Runs != 1 || stats.FilesChecked != 2 || stats.CorruptFiles != 1 {
+		t.Errorf("Scrub stats = %+v", stats)
+	}
+	if good.corruption() != nil || bad.corruption() == nil {
+		t.Fatalf("Only the damaged file should be marked corrupt")
+	}
+
+	if _, _, err := set.get([]byte("key001"), maxSequence); !errors.Is(err, ErrCorruptSST) {
+		t.Errorf("Get of a key of the corrupt file returned %v, expected ErrCorruptSST", err)
+	}
+	if entry, found, err := set.get(testEntries(100)[0].Key, maxSequence); err != nil || !found {
+		t.Errorf("Get of a key only in the good file = %v %v %v", entry, found, err)
+	}
+}
+
+// A file a compaction replaced while the scrubber was getting to it is
+// Neither reported nor closed under the readers still using it
+func TestScrubSkipsReplacedFiles(t *testing.T) {
+	set := newTestTableSet(t)
+	replaced := addTestSST(t, set, 0, testEntries(100))
+	data, _ := os.ReadFile(replaced.file.Name())
+	data[sstHeaderSize+10] ^= 0xff
+	os.WriteFile(replaced.file.Name(), data, 0644)
+	replaced.obsolete.Store(true)
+
+	set.scrub(1<<30, make(chan struct{}))
+
+	if stats := set.ScrubStats(); stats.FilesChecked != 0 || stats.CorruptFiles != 0 || replaced.corruption() != nil {
+		t.Errorf("The replaced file should be skipped, got %+v", stats)
+	}
+	if refs := replaced.refs.Load(); refs != 1 {
+		t.Errorf("The scrubber left %d references to the file, expected 1", refs)
+	}
+}
+
+func TestScrubRateLimit(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 100*1024)
+	limiter := &rateLimitedReader{reader: bytes.NewReader(data), rate: 1024 * 1024, start: time.Now(), stop: make(chan struct{})}
+
+	start := time.Now()
+	if err := verifyChecksumStream(limiter, int64(len(data)), version); !errors.Is(err, ErrCorruptSST) {
+		t.Errorf("verifyChecksumStream returned %v, expected a checksum mismatch", err)
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("Reading 100KiB at 1MiB/s took %v", elapsed)
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+	limiter = &rateLimitedReader{reader: bytes.NewReader(data), rate: 1, start: time.Now(), stop: stop}
+	if err := verifyChecksumStream(limiter, int64(len(data)), version); err != errScrubStopped {
+		t.Errorf("A stopped scrub returned %v", err)
+	}
+}
+
+func TestDBScrubsInBackground(t *testing.T) {
+	db := openTestDB(t, t.TempDir(), &Options{MemtableEntries: 10, ScrubInterval: time.Millisecond})
+	for i := 0; i < 10; i++ {
+		db.Put([]byte(fmt.Sprint(i)), []byte("value"))
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for db.Stats().Scrub.FilesChecked == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if stats := db.Stats().Scrub; stats.FilesChecked == 0 || stats.CorruptFiles != 0 {
+		t.Errorf("Scrub stats = %+v", stats)
+	}
+}
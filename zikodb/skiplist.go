@@ -0,0 +1,245 @@
+package zikodb
+
+import (
+	"bytes"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	skipListMaxLevel = 16
+	skipListP        = 0.25
+
+	// Rough memory used by a node besides its key, its value and its
+	// Forward pointers: the entry and the slice headers
+	skipNodeOverhead = 80
+)
+
+type skipNode struct {
+	entry entry
+	next  []*skipNode
+}
+
+// A skiplist keeps entries ordered by key. It is safe for concurrent
+// use: lookups and iterators share a read lock while writers take it
+// exclusively. Nodes are never unlinked, a delete is just another
+// entry, which is what lets iterators walk the list step by step.
+// Every write of a key is kept, the versions of a key follow each other
+// From the newest to the oldest so that reads at an older sequence
+// Number still find the version they see
+type skipList struct {
+	mu     sync.RWMutex
+	head   *skipNode
+	level  int
+	length int
+	rnd    *rand.Rand
+
+	// Approximate memory footprint of the entries in bytes
+	size int64
+}
+
+func newSkipList() *skipList {
+	return &skipList{
+		head:  &skipNode{next: make([]*skipNode, skipListMaxLevel)},
+		level: 1,
+		rnd:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (s *skipList) randomLevel() int {
+	level := 1
+	for level < skipListMaxLevel && s.rnd.Float64() < skipListP {
+		level++
+	}
+	return level
+}
+
+// Find the last node whose key is smaller than the given key on every
+// level, the caller must hold the lock
+func (s *skipList) findPrevious(key []byte, prev []*skipNode) *skipNode {
+	return s.findVersion(key, maxSequence, prev)
+}
+
+// Find the last node before the version of key numbered seq on every
+// Level, that is before the versions of key numbered up to seq. The
+// Caller must hold the lock
+func (s *skipList) findVersion(key []byte, seq uint64, prev []*skipNode) *skipNode {
+	node := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && versionBefore(node.next[i].entry, key, seq) {
+			node = node.next[i]
+		}
+		if prev != nil {
+			prev[i] = node
+		}
+	}
+	return node.next[0]
+}
+
+// Whether entry comes before the version of key numbered seq
+func versionBefore(entry entry, key []byte, seq uint64) bool {
+	c := bytes.Compare(entry.Key, key)
+	return c < 0 || c == 0 && entry.Seq > seq
+}
+
+// Find the last node whose key is smaller than key, nil when there is
+// None. The caller must hold the lock
+func (s *skipList) findLess(key []byte) *skipNode {
+	node := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && bytes.Compare(node.next[i].entry.Key, key) < 0 {
+			node = node.next[i]
+		}
+	}
+	if node == s.head {
+		return nil
+	}
+	return node
+}
+
+// Find the last node, nil when the list is empty. The caller must hold
+// The lock
+func (s *skipList) findLast() *skipNode {
+	node := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for node.next[i] != nil {
+			node = node.next[i]
+		}
+	}
+	if node == s.head {
+		return nil
+	}
+	return node
+}
+
+// Insert an entry among the versions of its key, it replaces the
+// Version with the same sequence number if there is one
+func (s *skipList) Put(entry entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev := make([]*skipNode, skipListMaxLevel)
+	node := s.findVersion(entry.Key, entry.Seq, prev)
+	if node != nil && bytes.Equal(node.entry.Key, entry.Key) && node.entry.Seq == entry.Seq {
+		s.size += int64(len(entry.Value) - len(node.entry.Value))
+		node.entry = entry
+		return
+	}
+
+	level := s.randomLevel()
+	if level > s.level {
+		for i := s.level; i < level; i++ {
+			prev[i] = s.head
+		}
+		s.level = level
+	}
+
+	node = &skipNode{entry: entry, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = prev[i].next[i]
+		prev[i].next[i] = node
+	}
+	s.length++
+	s.size += skipNodeSize(entry, level)
+}
+
+func skipNodeSize(entry entry, level int) int64 {
+	return int64(len(entry.Key)+len(entry.Value)+8*level) + skipNodeOverhead
+}
+
+// Get the newest entry of key numbered up to seq, tombstones included
+func (s *skipList) get(key []byte, seq uint64) (entry, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	node := s.findVersion(key, seq, nil)
+	if node != nil && bytes.Equal(node.entry.Key, key) {
+		return node.entry, true
+	}
+	return entry{}, false
+}
+
+func (s *skipList) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.length
+}
+
+// Approximate number of bytes used by the entries
+func (s *skipList) Size() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.size
+}
+
+func (s *skipList) NewIterator() *skipListIterator {
+	return &skipListIterator{list: s}
+}
+
+// An iterator that walks a skiplist in key order, in both directions. A
+// Fresh iterator is not positioned, call one of the Seek methods first
+type skipListIterator struct {
+	list *skipList
+	node *skipNode
+}
+
+func (it *skipListIterator) SeekToFirst() {
+	it.list.mu.RLock()
+	defer it.list.mu.RUnlock()
+
+	it.node = it.list.head.next[0]
+}
+
+// Position the iterator on the first entry whose key is >= key
+func (it *skipListIterator) Seek(key []byte) {
+	it.list.mu.RLock()
+	defer it.list.mu.RUnlock()
+
+	it.node = it.list.findPrevious(key, nil)
+}
+
+func (it *skipListIterator) SeekToLast() {
+	it.list.mu.RLock()
+	defer it.list.mu.RUnlock()
+
+	it.node = it.list.findLast()
+}
+
+func (it *skipListIterator) Valid() bool {
+	return it.node != nil
+}
+
+func (it *skipListIterator) Next() {
+	it.list.mu.RLock()
+	defer it.list.mu.RUnlock()
+
+	it.node = it.node.next[0]
+}
+
+// Nodes only link forward, so the list is searched again for the last
+// Key smaller than the current one, then walked up to the current node
+// Past the newer versions of its key
+func (it *skipListIterator) Prev() {
+	it.list.mu.RLock()
+	defer it.list.mu.RUnlock()
+
+	previous := it.list.findLess(it.node.entry.Key)
+	next := it.list.head.next[0]
+	if previous != nil {
+		next = previous.next[0]
+	}
+	for next != it.node {
+		previous, next = next, next.next[0]
+	}
+	it.node = previous
+}
+
+func (it *skipListIterator) Entry() entry {
+	it.list.mu.RLock()
+	defer it.list.mu.RUnlock()
+
+	return it.node.entry
+}
@@ -0,0 +1,146 @@
+package zikodb
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Reads that are not made through a snapshot see every write
+const maxSequence = math.MaxUint64
+
+var ErrSnapshotReleased = errors.New("zikodb: snapshot is released")
+
+// The sequence numbers pinned by the live snapshots and iterators, with
+// One element per reader. A version of a key that is replaced by a
+// Newer write is kept as long as one of them can still see it
+type snapshotList struct {
+	mu   sync.Mutex
+	seqs []uint64
+}
+
+func (l *snapshotList) add(seq uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	i := sort.Search(len(l.seqs), func(i int) bool { return l.seqs[i] >= seq })
+	l.seqs = append(l.seqs, 0)
+	copy(l.seqs[i+1:], l.seqs[i:])
+	l.seqs[i] = seq
+}
+
+// Add the sequence number visible holds and return it. Taking it under
+// The lock keeps a compaction from dropping a version the reader needs
+// Between the two
+func (l *snapshotList) pin(visible *atomic.Uint64) uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	seq := visible.Load()
+	i := sort.Search(len(l.seqs), func(i int) bool { return l.seqs[i] >= seq })
+	l.seqs = append(l.seqs, 0)
+	copy(l.seqs[i+1:], l.seqs[i:])
+	l.seqs[i] = seq
+	return seq
+}
+
+func (l *snapshotList) remove(seq uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	i := sort.Search(len(l.seqs), func(i int) bool { return l.seqs[i] >= seq })
+	if i < len(l.seqs) && l.seqs[i] == seq {
+		l.seqs = append(l.seqs[:i], l.seqs[i+1:]...)
+	}
+}
+
+// Whether a reader sees the version of a key numbered seq when the next
+// Version of the key is numbered next, that is when one of them was
+// Taken in [seq, next)
+func (l *snapshotList) needs(seq, next uint64) bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	i := sort.Search(len(l.seqs), func(i int) bool { return l.seqs[i] >= seq })
+	return i < len(l.seqs) && l.seqs[i] < next
+}
+
+// The sequence number of the oldest reader, maxSequence when there is
+// None
+func (l *snapshotList) oldest() uint64 {
+	if l == nil {
+		return maxSequence
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.seqs) == 0 {
+		return maxSequence
+	}
+	return l.seqs[0]
+}
+
+// A Snapshot reads the database as it was when the snapshot was taken,
+// Later writes are not seen. Compactions keep the versions of the keys
+// It needs until it is released, so a snapshot should not be held
+// Longer than necessary
+type Snapshot struct {
+	db       *DB
+	seq      uint64
+	released atomic.Bool
+}
+
+// Take a snapshot of the database, it must be released
+func (db *DB) NewSnapshot() (*Snapshot, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return nil, ErrClosed
+	}
+	return &Snapshot{db: db, seq: db.memtable.pinSequence()}, nil
+}
+
+// The sequence number of the last write the snapshot sees
+func (s *Snapshot) Sequence() uint64 {
+	return s.seq
+}
+
+// Get the value key had when the snapshot was taken
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	if s.released.Load() {
+		return nil, ErrSnapshotReleased
+	}
+	return s.db.get(key, s.seq)
+}
+
+// Iterate over the keys in [start, end) as they were when the snapshot
+// Was taken, see DB.NewIterator
+func (s *Snapshot) NewIterator(start, end []byte) (*Iterator, error) {
+	if s.released.Load() {
+		return nil, ErrSnapshotReleased
+	}
+	return s.db.newIterator(start, end, nil, s.seq)
+}
+
+// Iterate over the keys starting with prefix as they were when the
+// Snapshot was taken, see DB.NewPrefixIterator
+func (s *Snapshot) NewPrefixIterator(prefix []byte) (*Iterator, error) {
+	if s.released.Load() {
+		return nil, ErrSnapshotReleased
+	}
+	return s.db.newIterator(prefix, prefixEnd(prefix), prefix, s.seq)
+}
+
+// Let compactions drop the versions only the snapshot needed. The
+// Iterators opened from it keep working until they are closed
+func (s *Snapshot) Release() {
+	if s.released.CompareAndSwap(false, true) {
+		s.db.memtable.snapshots.remove(s.seq)
+	}
+}
@@ -0,0 +1,197 @@
+package zikodb
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// Compact every level 0 file into level 1, the database must be opened
+// With the background compactions turned off
+func compactLevel0(t *testing.T, db *DB) {
+	t.Helper()
+
+	db.tables.mu.RLock()
+	inputs := append([]*sstReader{}, db.tables.levels[0]...)
+	inputs = append(inputs, db.tables.levels[1]...)
+	db.tables.mu.RUnlock()
+	c := &compaction{level: 0, outputLevel: 1, inputs: inputs, isBaseLevel: func([]byte) bool { return true }}
+	outputs, err := db.tables.runCompaction(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.tables.install(c, outputs); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Collect the keys and values seen by a snapshot, walking backwards when
+// Reverse is set
+func scanSnapshot(t *testing.T, s *Snapshot, reverse bool) string {
+	t.Helper()
+
+	it, err := s.NewIterator(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+
+	var result string
+	if reverse {
+		for it.SeekToLast(); it.Valid(); it.Prev() {
+			result += fmt.Sprintf("%s=%s ", it.Key(), it.Value())
+		}
+	} else {
+		for ; it.Valid(); it.Next() {
+			result += fmt.Sprintf("%s=%s ", it.Key(), it.Value())
+		}
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestSnapshotReads(t *testing.T) {
+	db := openTestDB(t, t.TempDir(), &Options{disableCompaction: true})
+	db.Put([]byte("a"), []byte("1"))
+	db.Put([]byte("b"), []byte("1"))
+
+	s, err := db.NewSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put([]byte("a"), []byte("2"))
+	db.Delete([]byte("b"))
+	db.Put([]byte("c"), []byte("2"))
+
+	check := func(stage string) {
+		t.Helper()
+		if value, err := s.Get([]byte("a")); err != nil || string(value) != "1" {
+			t.Errorf("%s: snapshot Get(a) = %q %v", stage, value, err)
+		}
+		if value, err := s.Get([]byte("b")); err != nil || string(value) != "1" {
+			t.Errorf("%s: snapshot Get(b) = %q %v", stage, value, err)
+		}
+		if _, err := s.Get([]byte("c")); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: snapshot Get(c) returned %v", stage, err)
+		}
+		if got := scanSnapshot(t, s, false); got != "a=1 b=1 " {
+			t.Errorf("%s: snapshot scan returned %q", stage, got)
+		}
+		if got := scanSnapshot(t, s, true); got != "b=1 a=1 " {
+			t.Errorf("%s: reverse snapshot scan returned %q", stage, got)
+		}
+		if got := scan(t, db, nil, nil); got != "a=2 c=2 " {
+			t.Errorf("%s: scan returned %q", stage, got)
+		}
+	}
+
+	check("memtable")
+	db.memtable.freeze(true)
+	db.memtable.waitForFlush()
+	check("flushed")
+	compactLevel0(t, db)
+	check("compacted")
+
+	// Once released the old versions are dropped by the next compaction
+	s.Release()
+	if _, err := s.Get([]byte("a")); !errors.Is(err, ErrSnapshotReleased) {
+		t.Errorf("Get on a released snapshot returned %v", err)
+	}
+	compactLevel0(t, db)
+	if stats := db.Stats().SSTFiles; len(stats) != 1 || stats[0].Entries != 2 {
+		t.Errorf("Expected a single sst file with the 2 live keys, got %+v", stats)
+	}
+	if got := scan(t, db, nil, nil); got != "a=2 c=2 " {
+		t.Errorf("Scan after the release returned %q", got)
+	}
+}
+
+func TestIteratorIsConsistent(t *testing.T) {
+	db := openTestDB(t, t.TempDir(), nil)
+	db.Put([]byte("a"), []byte("1"))
+	db.Put([]byte("b"), []byte("1"))
+
+	it, err := db.NewIterator(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+
+	// Writes made after the iterator was created are not seen, even once
+	// They are flushed
+	db.Put([]byte("b"), []byte("2"))
+	db.Put([]byte("c"), []byte("2"))
+	db.memtable.freeze(true)
+	db.memtable.waitForFlush()
+
+	var result string
+	for ; it.Valid(); it.Next() {
+		result += fmt.Sprintf("%s=%s ", it.Key(), it.Value())
+	}
+	if result != "a=1 b=1 " {
+		t.Errorf("Iterator returned %q", result)
+	}
+}
+
+func TestSkipListKeepsVersions(t *testing.T) {
+	s := newSkipList()
+	s.Put(entry{Key: []byte("a"), Value: []byte("1"), Seq: 1})
+	s.Put(entry{Key: []byte("a"), Value: []byte("3"), Seq: 3})
+	// Writes can reach the skiplist out of order
+	s.Put(entry{Key: []byte("a"), Value: []byte("2"), Seq: 2})
+
+	for seq, expected := range map[uint64]string{1: "1", 2: "2", 3: "3", maxSequence: "3"} {
+		if entry, ok := s.get([]byte("a"), seq); !ok || string(entry.Value) != expected {
+			t.Errorf("get(a, %d) = %q %v, expected %q", seq, entry.Value, ok, expected)
+		}
+	}
+	if _, ok := s.get([]byte("a"), 0); ok {
+		t.Errorf("get(a, 0) found a version")
+	}
+	if s.Len() != 3 {
+		t.Errorf("Expected the 3 versions, got %d", s.Len())
+	}
+}
+
+func TestFlushKeepsVersionsForSnapshots(t *testing.T) {
+	set := newTestTableSet(t)
+	data := newSkipList()
+	for seq := uint64(1); seq <= 3; seq++ {
+		data.Put(entry{Kind: kindSet, Key: []byte("a"), Value: []byte(fmt.Sprint(seq)), Seq: seq})
+	}
+	set.snapshots.add(1)
+	if err := set.writeSST(data); err != nil {
+		t.Fatal(err)
+	}
+
+	for seq, expected := range map[uint64]string{1: "1", maxSequence: "3"} {
+		if entry, ok, err := set.get([]byte("a"), seq); err != nil || !ok || string(entry.Value) != expected {
+			t.Errorf("get(a, %d) = %q %v %v, expected %q", seq, entry.Value, ok, err, expected)
+		}
+	}
+	if entries := set.levels[0][0].entryCount; entries != 2 {
+		t.Errorf("Expected the version seen by the snapshot and the newest one, got %d", entries)
+	}
+}
+
+func TestSnapshotListNeeds(t *testing.T) {
+	l := &snapshotList{}
+	l.add(5)
+	l.add(3)
+	l.add(5)
+	l.remove(5)
+
+	for _, test := range []struct {
+		seq, next uint64
+		expected  bool
+	}{{1, 3, false}, {1, 4, true}, {3, 4, true}, {4, 5, false}, {4, 6, true}, {6, 9, false}} {
+		if got := l.needs(test.seq, test.next); got != test.expected {
+			t.Errorf("needs(%d, %d) = %v", test.seq, test.next, got)
+		}
+	}
+	if l.oldest() != 3 {
+		t.Errorf("oldest() = %d", l.oldest())
+	}
+}
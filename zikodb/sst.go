@@ -0,0 +1,432 @@
+package zikodb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	magicNumber   = uint32(0x23102003)
+	version       = uint16(2)
+	legacyVersion = uint16(1)
+
+	// How long to wait before retrying a failed memtable flush
+	flushRetryDelay = time.Second
+
+	// Target size of a data block before it gets sealed
+	blockSize = 4 * 1024
+
+	// Files are written under their name with this suffix and only
+	// Renamed once complete, leftovers of a crash are removed on startup
+	tempFileSuffix = ".tmp"
+
+	// Subdirectory of the sst directory where corrupt files are moved
+	quarantineDir = "quarantine"
+)
+
+// Layout of a version 2 sst file:
+//
+//	header:  magic u32 | 0 u32 | 0 u32 | 0 u32 | version u16
+//	blocks:  { opType u8 | seq u64 | keyLen u32 | key | valueLen u32 | value }... | crc32c u32
+//	index:   count u32 | { lastKeyLen u32 | lastKey | offset u64 | size u32 }...
+//	filter:  bloom filter bits | probes u8
+//	footer:  entryCount u32 | minKeyLen u32 | minKey | maxKeyLen u32 | maxKey |
+//	         indexOffset u64 | indexSize u32 | filterOffset u64 | filterSize u32 |
+//	         prefixFilterOffset u64 | prefixFilterSize u32 | delimiterLen u32 | delimiter |
+//	         footerSize u32
+//	trailer: crc32c u32 of everything before it
+//
+// The header keeps the shape of a version 1 header with empty keys so
+// that the version field sits where older readers expect it. The real
+// entry count and key range live in the footer since they are only
+// known once every block has been written. Entries are sorted by key,
+// the versions of a key kept for snapshots from the newest to the
+// oldest. The filter block and its handle in the footer are optional,
+// a filterSize of 0 means no filter.
+// The prefix filter holds the prefixes of the keys that end with the
+// Delimiter, it follows the key filter and is optional as well.
+type sstFile struct {
+	filename    string
+	file        *os.File
+	finished    bool
+	writer      *bufio.Writer
+	hash        hash.Hash32
+	offset      uint64
+	entryCount  uint32
+	smallestKey []byte
+	largestKey  []byte
+	largestSeq  uint64
+	lastSeq     uint64
+	version     uint16
+	checksum    uint32
+
+	block        bytes.Buffer
+	blockLastKey []byte
+	index        []blockHandle
+
+	bitsPerKey int
+	keyHashes  []uint32
+
+	// Nil when the file gets no prefix filter
+	prefixDelimiter []byte
+	prefixHashes    []uint32
+}
+
+// Location of a data block, the index stores one per block
+type blockHandle struct {
+	lastKey []byte
+	offset  uint64
+	size    uint32
+}
+
+// Create an sst file, it is written under a temporary name and only
+// Appears under filename once Finish returns. The checksum of the file
+// Is computed along as the bytes are written
+func newSSTFile(filename string) (*sstFile, error) {
+	file, err := os.OpenFile(filename+tempFileSuffix, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	checksum := newSSTHash(version)
+	s := &sstFile{
+		filename:   filename,
+		file:       file,
+		writer:     bufio.NewWriter(io.MultiWriter(file, checksum)),
+		hash:       checksum,
+		version:    version,
+		bitsPerKey: defaultBloomBitsPerKey,
+	}
+
+	if err := s.writeHeader(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Write the entries of a memtable to a new sst file and record it
+// In the manifest, the file is only live once this returns
+func (s *tableSet) writeSST(data *skipList) error {
+	filename := s.newTableFile()
+	file, err := newSSTFile(filename)
+	if err != nil {
+		return err
+	}
+	file.prefixDelimiter = s.prefixDelimiter
+	file.bitsPerKey = s.bloomBitsPerKey
+	defer file.Close()
+
+	if err := file.Write(data, s.snapshots); err != nil {
+		os.Remove(filename)
+		return err
+	}
+	if err := s.add(filename, file.largestSeq); err != nil {
+		os.Remove(filename)
+		return err
+	}
+
+	s.logger.Println("Data flushed to ", filename)
+	s.scheduleCompaction()
+	return nil
+}
+
+// Write the contents of a memtable to the sst file. Of the versions of
+// A key only the newest one and those a snapshot still sees are kept,
+// The same way compactions do
+func (s *sstFile) Write(data *skipList, snapshots *snapshotList) error {
+	var key []byte
+	var next uint64
+
+	it := data.NewIterator()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		entry := it.Entry()
+		keep := s.entryCount == 0 || !bytes.Equal(entry.Key, key) || snapshots.needs(entry.Seq, next)
+		key, next = entry.Key, entry.Seq
+		if !keep {
+			continue
+		}
+		if err := s.Add(entry); err != nil {
+			return err
+		}
+	}
+
+	return s.Finish()
+}
+
+func (s *sstFile) write(data []byte) error {
+	n, err := s.writer.Write(data)
+	s.offset += uint64(n)
+	return err
+}
+
+func (s *sstFile) writeHeader() error {
+	header := make([]byte, 18)
+	binary.BigEndian.PutUint32(header[0:], magicNumber)
+	binary.BigEndian.PutUint16(header[16:], s.version)
+	return s.write(header)
+}
+
+// Append an entry to the current data block, entries must be added in
+// Increasing key order. Several versions of a key kept for snapshots
+// Are added from the newest to the oldest
+func (s *sstFile) Add(entry entry) error {
+	sameKey := s.entryCount > 0 && bytes.Equal(entry.Key, s.largestKey)
+	if s.entryCount > 0 && bytes.Compare(entry.Key, s.largestKey) < 0 ||
+		sameKey && entry.Seq >= s.lastSeq {
+		return fmt.Errorf("key %q added out of order", entry.Key)
+	}
+
+	if s.bitsPerKey > 0 && len(s.prefixDelimiter) > 0 && !sameKey {
+		s.addPrefixes(entry.Key, s.largestKey)
+	}
+
+	if s.entryCount == 0 {
+		s.smallestKey = entry.Key
+	}
+	s.largestKey = entry.Key
+	if entry.Seq > s.largestSeq {
+		s.largestSeq = entry.Seq
+	}
+	s.lastSeq = entry.Seq
+	s.entryCount++
+
+	encodeEntry(&s.block, entry)
+	s.blockLastKey = entry.Key
+	if s.bitsPerKey > 0 && !sameKey {
+		s.keyHashes = append(s.keyHashes, bloomHash(entry.Key))
+	}
+
+	if s.block.Len() >= blockSize {
+		return s.finishBlock()
+	}
+	return nil
+}
+
+// Hash the prefixes of key ending with the delimiter. Keys are added in
+// Order, so the prefixes shared with the previous key are already in
+func (s *sstFile) addPrefixes(key []byte, previous []byte) {
+	end := 0
+	for {
+		i := bytes.Index(key[end:], s.prefixDelimiter)
+		if i < 0 {
+			return
+		}
+		end += i + len(s.prefixDelimiter)
+		if !bytes.HasPrefix(previous, key[:end]) {
+			s.prefixHashes = append(s.prefixHashes, bloomHash(key[:end]))
+		}
+	}
+}
+
+// Write the pending data block followed by its checksum
+func (s *sstFile) finishBlock() error {
+	if s.block.Len() == 0 {
+		return nil
+	}
+
+	handle := blockHandle{
+		lastKey: s.blockLastKey,
+		offset:  s.offset,
+		size:    uint32(s.block.Len()),
+	}
+
+	checksum := make([]byte, 4)
+	binary.BigEndian.PutUint32(checksum, sstChecksum(s.block.Bytes()))
+
+	if err := s.write(s.block.Bytes()); err != nil {
+		return err
+	}
+	if err := s.write(checksum); err != nil {
+		return err
+	}
+
+	s.index = append(s.index, handle)
+	s.block.Reset()
+	return nil
+}
+
+// Seal the last block, then write the index, the bloom filter,
+// The footer and the checksum of the whole file. The complete file
+// Is then synced and moved under its name
+func (s *sstFile) Finish() error {
+	if err := s.finishBlock(); err != nil {
+		return err
+	}
+
+	var index bytes.Buffer
+	binary.Write(&index, binary.BigEndian, uint32(len(s.index)))
+	for _, handle := range s.index {
+		binary.Write(&index, binary.BigEndian, uint32(len(handle.lastKey)))
+		index.Write(handle.lastKey)
+		binary.Write(&index, binary.BigEndian, handle.offset)
+		binary.Write(&index, binary.BigEndian, handle.size)
+	}
+
+	indexOffset := s.offset
+	if err := s.write(index.Bytes()); err != nil {
+		return err
+	}
+
+	var filter []byte
+	if s.bitsPerKey > 0 {
+		filter = newBloomFilter(s.keyHashes, s.bitsPerKey).encode()
+	}
+
+	filterOffset := s.offset
+	if err := s.write(filter); err != nil {
+		return err
+	}
+
+	// A file without any key holding the delimiter still gets an empty
+	// Filter, which rules out every prefix
+	var prefixFilter []byte
+	if s.bitsPerKey > 0 && len(s.prefixDelimiter) > 0 {
+		prefixFilter = newBloomFilter(s.prefixHashes, s.bitsPerKey).encode()
+	}
+
+	prefixFilterOffset := s.offset
+	if err := s.write(prefixFilter); err != nil {
+		return err
+	}
+
+	var footer bytes.Buffer
+	binary.Write(&footer, binary.BigEndian, s.entryCount)
+	binary.Write(&footer, binary.BigEndian, uint32(len(s.smallestKey)))
+	footer.Write(s.smallestKey)
+	binary.Write(&footer, binary.BigEndian, uint32(len(s.largestKey)))
+	footer.Write(s.largestKey)
+	binary.Write(&footer, binary.BigEndian, indexOffset)
+	binary.Write(&footer, binary.BigEndian, uint32(index.Len()))
+	binary.Write(&footer, binary.BigEndian, filterOffset)
+	binary.Write(&footer, binary.BigEndian, uint32(len(filter)))
+	binary.Write(&footer, binary.BigEndian, prefixFilterOffset)
+	binary.Write(&footer, binary.BigEndian, uint32(len(prefixFilter)))
+	binary.Write(&footer, binary.BigEndian, uint32(len(s.prefixDelimiter)))
+	footer.Write(s.prefixDelimiter)
+	binary.Write(&footer, binary.BigEndian, uint32(footer.Len()))
+
+	if err := s.write(footer.Bytes()); err != nil {
+		return err
+	}
+	if err := s.writer.Flush(); err != nil {
+		return err
+	}
+
+	// The checksum covers every byte written so far
+	s.checksum = s.hash.Sum32()
+	if err := binary.Write(s.file, binary.BigEndian, s.checksum); err != nil {
+		return err
+	}
+
+	// The file must be on disk before it shows up under its name,
+	// And the rename on disk before the file is used
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(s.file.Name(), s.filename); err != nil {
+		return err
+	}
+	s.finished = true
+	return syncDir(filepath.Dir(s.filename))
+}
+
+// Encode an entry the way it is laid out inside a data block
+func encodeEntry(buf *bytes.Buffer, entry entry) {
+	buf.WriteByte(byte(entry.Kind))
+	binary.Write(buf, binary.BigEndian, entry.Seq)
+	binary.Write(buf, binary.BigEndian, uint32(len(entry.Key)))
+	buf.Write(entry.Key)
+	binary.Write(buf, binary.BigEndian, uint32(len(entry.Value)))
+	buf.Write(entry.Value)
+}
+
+// Check every live sst file against its checksum. Corrupt files are
+// Moved to the quarantine directory and dropped from the manifest so
+// That reads never see them, Repair can still salvage what they hold
+func (s *tableSet) integrityCheck() error {
+	s.mu.RLock()
+	var files []*sstReader
+	for _, level := range s.levels {
+		files = append(files, level...)
+	}
+	s.mu.RUnlock()
+
+	s.logger.Println("Integrity Check Using Checksums:")
+	var corrupt []*sstReader
+	for _, sst := range files {
+		result := "Ok"
+		if err := verifyChecksumStream(io.NewSectionReader(sst.file, 0, sst.size), sst.size, sst.version); err != nil {
+			result = fmt.Sprintf("Fail (%v)", err)
+			corrupt = append(corrupt, sst)
+		}
+		s.logger.Printf("SST file: %s - %s\n", filepath.Base(sst.file.Name()), result)
+	}
+
+	if len(corrupt) == 0 {
+		return nil
+	}
+	return s.quarantine(corrupt)
+}
+
+// Move corrupt files out of the live set. They are moved before the
+// Manifest forgets them, a crash in between leaves a live file that
+// Cannot be opened rather than a corrupt one that is served
+func (s *tableSet) quarantine(files []*sstReader) error {
+	for _, sst := range files {
+		if err := quarantineFile(s.dir, filepath.Base(sst.file.Name())); err != nil {
+			return err
+		}
+		s.logger.Println("Quarantined corrupt SST file:", filepath.Base(sst.file.Name()))
+	}
+
+	if err := s.replace(files, 0, nil); err != nil {
+		return err
+	}
+	for _, sst := range files {
+		sst.unref()
+	}
+	return nil
+}
+
+func quarantineFile(dir string, name string) error {
+	quarantine := filepath.Join(dir, quarantineDir)
+	if err := os.MkdirAll(quarantine, 0755); err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(dir, name), filepath.Join(quarantine, name))
+}
+
+var sstChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Hash of the whole file, version 1 files are checksummed with crc32
+// IEEE and the block based ones with crc32c
+func newSSTHash(fileVersion uint16) hash.Hash32 {
+	if fileVersion == legacyVersion {
+		return crc32.NewIEEE()
+	}
+	return crc32.New(sstChecksumTable)
+}
+
+// Checksum of a data block
+func sstChecksum(data []byte) uint32 {
+	return crc32.Checksum(data, sstChecksumTable)
+}
+
+// Close the file, a file that was not finished is removed
+func (s *sstFile) Close() error {
+	err := s.file.Close()
+	if !s.finished {
+		os.Remove(s.file.Name())
+	}
+	return err
+}
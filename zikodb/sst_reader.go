@@ -0,0 +1,639 @@
+package zikodb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+)
+
+// Returned by reads of a file that failed its checksum
+var ErrCorruptSST = errors.New("zikodb: corrupt sst file")
+
+var (
+	errCorruptBlock     = fmt.Errorf("%w: bad block", ErrCorruptSST)
+	errChecksumMismatch = fmt.Errorf("%w: checksum mismatch", ErrCorruptSST)
+)
+
+// Read side of an sst file, it understands both the legacy
+// Version 1 layout and the block based version 2 layout
+type sstReader struct {
+	file        *os.File
+	size        int64
+	level       int
+	seq         uint64
+	version     uint16
+	entryCount  uint32
+	smallestKey []byte
+	largestKey  []byte
+
+	// Version 1 files have a single implicit block that starts
+	// Right after the header and ends before the checksum
+	index []blockHandle
+
+	// Nil for files written without a bloom filter
+	filter *bloomFilter
+
+	// Nil for files written without a prefix filter, the prefixes it
+	// Holds end with the delimiter
+	prefixFilter    *bloomFilter
+	prefixDelimiter []byte
+
+	// Lookups of absent keys rejected by the filter, and the ones
+	// The filter let through, which are its false positives
+	filterNegatives      atomic.Uint64
+	filterFalsePositives atomic.Uint64
+
+	// Prefix scans that skipped the file thanks to the prefix filter
+	prefixFilterNegatives atomic.Uint64
+
+	// Set once the scrubber finds the file corrupt, reads of the file
+	// Then fail instead of returning what it holds
+	corrupt atomic.Pointer[error]
+
+	// The table set holds a reference to the files it serves, every
+	// Iterator one to the files it reads and the scrubber one to the
+	// Files it checks, so that a file replaced by a compaction stays
+	// Open until the last of them is done with it
+	refs     atomic.Int32
+	obsolete atomic.Bool
+}
+
+func openSST(filename string) (*sstReader, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &sstReader{file: file}
+	r.refs.Store(1)
+	if err := r.readHeader(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	return r, nil
+}
+
+func (r *sstReader) readHeader() error {
+	info, err := r.file.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	r.size = size
+
+	reader := bufio.NewReader(io.NewSectionReader(r.file, 0, size))
+
+	var magic, entryCount, smallestKeyLen, largestKeyLen uint32
+	if err := binary.Read(reader, binary.BigEndian, &magic); err != nil {
+		return err
+	}
+	if magic != magicNumber {
+		return errors.New("invalid sst file format")
+	}
+
+	if err := binary.Read(reader, binary.BigEndian, &entryCount); err != nil {
+		return err
+	}
+	if err := binary.Read(reader, binary.BigEndian, &smallestKeyLen); err != nil {
+		return err
+	}
+	if _, err := readBytes(reader, smallestKeyLen, size); err != nil {
+		return err
+	}
+	if err := binary.Read(reader, binary.BigEndian, &largestKeyLen); err != nil {
+		return err
+	}
+	if _, err := readBytes(reader, largestKeyLen, size); err != nil {
+		return err
+	}
+	if err := binary.Read(reader, binary.BigEndian, &r.version); err != nil {
+		return err
+	}
+
+	switch r.version {
+	case legacyVersion:
+		r.entryCount = entryCount
+
+		headerSize := uint64(18 + smallestKeyLen + largestKeyLen)
+		if uint64(size) < headerSize+4 {
+			return io.ErrUnexpectedEOF
+		}
+		r.index = []blockHandle{{
+			offset: headerSize,
+			size:   uint32(uint64(size) - headerSize - 4),
+		}}
+
+		// The header holds the keys with the smallest and largest
+		// Lengths, the actual key range is found by sorting the file
+		entries, err := r.readBlock(0)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			r.smallestKey = entries[0].Key
+			r.largestKey = entries[len(entries)-1].Key
+		}
+		return nil
+	case version:
+		return r.readFooter(size)
+	default:
+		return fmt.Errorf("unsupported sst version %d", r.version)
+	}
+}
+
+// Read the footer and the index block of a version 2 file
+func (r *sstReader) readFooter(size int64) error {
+	if size < 18+8 {
+		return io.ErrUnexpectedEOF
+	}
+
+	tail := make([]byte, 8)
+	if _, err := r.file.ReadAt(tail, size-8); err != nil {
+		return err
+	}
+	footerSize := int64(binary.BigEndian.Uint32(tail))
+	if footerSize > size-18-8 {
+		return io.ErrUnexpectedEOF
+	}
+
+	footer := make([]byte, footerSize)
+	if _, err := r.file.ReadAt(footer, size-8-footerSize); err != nil {
+		return err
+	}
+
+	reader := bytes.NewReader(footer)
+	var smallestKeyLen, largestKeyLen, indexSize uint32
+	var indexOffset uint64
+	if err := binary.Read(reader, binary.BigEndian, &r.entryCount); err != nil {
+		return err
+	}
+	if err := binary.Read(reader, binary.BigEndian, &smallestKeyLen); err != nil {
+		return err
+	}
+	smallestKey, err := readBytes(reader, smallestKeyLen, footerSize)
+	if err != nil {
+		return err
+	}
+	if err := binary.Read(reader, binary.BigEndian, &largestKeyLen); err != nil {
+		return err
+	}
+	largestKey, err := readBytes(reader, largestKeyLen, footerSize)
+	if err != nil {
+		return err
+	}
+	if err := binary.Read(reader, binary.BigEndian, &indexOffset); err != nil {
+		return err
+	}
+	if err := binary.Read(reader, binary.BigEndian, &indexSize); err != nil {
+		return err
+	}
+	r.smallestKey = smallestKey
+	r.largestKey = largestKey
+
+	var filterOffset, prefixFilterOffset uint64
+	var filterSize, prefixFilterSize, delimiterLen uint32
+	if err := binary.Read(reader, binary.BigEndian, &filterOffset); err != nil {
+		return err
+	}
+	if err := binary.Read(reader, binary.BigEndian, &filterSize); err != nil {
+		return err
+	}
+	if r.filter, err = r.readFilter(filterOffset, filterSize, size); err != nil {
+		return err
+	}
+
+	if err := binary.Read(reader, binary.BigEndian, &prefixFilterOffset); err != nil {
+		return err
+	}
+	if err := binary.Read(reader, binary.BigEndian, &prefixFilterSize); err != nil {
+		return err
+	}
+	if err := binary.Read(reader, binary.BigEndian, &delimiterLen); err != nil {
+		return err
+	}
+	if r.prefixDelimiter, err = readBytes(reader, delimiterLen, footerSize); err != nil {
+		return err
+	}
+	if r.prefixFilter, err = r.readFilter(prefixFilterOffset, prefixFilterSize, size); err != nil {
+		return err
+	}
+
+	if indexOffset+uint64(indexSize) > uint64(size) {
+		return io.ErrUnexpectedEOF
+	}
+	index := make([]byte, indexSize)
+	if _, err := r.file.ReadAt(index, int64(indexOffset)); err != nil {
+		return err
+	}
+
+	reader = bytes.NewReader(index)
+	var count uint32
+	if err := binary.Read(reader, binary.BigEndian, &count); err != nil {
+		return err
+	}
+	for i := uint32(0); i < count; i++ {
+		var handle blockHandle
+		var keyLen uint32
+		if err := binary.Read(reader, binary.BigEndian, &keyLen); err != nil {
+			return err
+		}
+		if handle.lastKey, err = readBytes(reader, keyLen, int64(indexSize)); err != nil {
+			return err
+		}
+		if err := binary.Read(reader, binary.BigEndian, &handle.offset); err != nil {
+			return err
+		}
+		if err := binary.Read(reader, binary.BigEndian, &handle.size); err != nil {
+			return err
+		}
+		r.index = append(r.index, handle)
+	}
+
+	return nil
+}
+
+// Load a bloom filter block in memory, nil when the file has none
+func (r *sstReader) readFilter(offset uint64, size uint32, fileSize int64) (*bloomFilter, error) {
+	if size == 0 {
+		return nil, nil
+	}
+	if offset+uint64(size) > uint64(fileSize) {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	data := make([]byte, size)
+	if _, err := r.file.ReadAt(data, int64(offset)); err != nil {
+		return nil, err
+	}
+
+	filter, ok := decodeBloomFilter(data)
+	if !ok {
+		return nil, errors.New("invalid bloom filter block")
+	}
+	return filter, nil
+}
+
+// Read n bytes, refusing lengths that cannot fit in what is left
+func readBytes(reader io.Reader, n uint32, limit int64) ([]byte, error) {
+	if int64(n) > limit {
+		return nil, io.ErrUnexpectedEOF
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Read and decode the i-th block, verifying its checksum
+func (r *sstReader) readBlock(i int) ([]entry, error) {
+	if err := r.corruption(); err != nil {
+		return nil, err
+	}
+	handle := r.index[i]
+
+	if r.version == legacyVersion {
+		data := make([]byte, handle.size)
+		if _, err := r.file.ReadAt(data, int64(handle.offset)); err != nil {
+			return nil, err
+		}
+		entries, err := decodeLegacyEntries(data, r.entryCount)
+		if err != nil {
+			return nil, err
+		}
+
+		// Version 1 entries are sorted once loaded so that every
+		// File can be searched and iterated in key order
+		sort.Slice(entries, func(i, j int) bool {
+			return bytes.Compare(entries[i].Key, entries[j].Key) < 0
+		})
+		return entries, nil
+	}
+
+	data := make([]byte, handle.size+4)
+	if _, err := r.file.ReadAt(data, int64(handle.offset)); err != nil {
+		return nil, err
+	}
+
+	stored := binary.BigEndian.Uint32(data[handle.size:])
+	data = data[:handle.size]
+	if sstChecksum(data) != stored {
+		return nil, fmt.Errorf("%s: %w at offset %d", r.file.Name(), errCorruptBlock, handle.offset)
+	}
+
+	return decodeEntries(data)
+}
+
+// Decode the entries of a version 2 data block
+func decodeEntries(data []byte) ([]entry, error) {
+	var entries []entry
+	for len(data) > 0 {
+		var entry entry
+		var ok bool
+		if entry, data, ok = decodeEntry(data, true, true); !ok {
+			return nil, errCorruptBlock
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Decode the entries of a version 1 file, del entries do not
+// Carry a value length in that format
+func decodeLegacyEntries(data []byte, count uint32) ([]entry, error) {
+	entries := make([]entry, 0, count)
+	for i := uint32(0); i < count; i++ {
+		if len(data) == 0 {
+			return nil, errCorruptBlock
+		}
+		var entry entry
+		var ok bool
+		if entry, data, ok = decodeEntry(data, false, entryKind(data[0]) == kindSet); !ok {
+			return nil, errCorruptBlock
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func decodeEntry(data []byte, hasSeq bool, hasValue bool) (entry, []byte, bool) {
+	var entry entry
+	if len(data) < 1 {
+		return entry, nil, false
+	}
+
+	entry.Kind = entryKind(data[0])
+	if entry.Kind != kindSet && entry.Kind != kindDelete {
+		return entry, nil, false
+	}
+	data = data[1:]
+
+	if hasSeq {
+		if len(data) < 8 {
+			return entry, nil, false
+		}
+		entry.Seq = binary.BigEndian.Uint64(data)
+		data = data[8:]
+	}
+
+	if len(data) < 4 {
+		return entry, nil, false
+	}
+	keyLen := binary.BigEndian.Uint32(data)
+	data = data[4:]
+	if uint64(len(data)) < uint64(keyLen) {
+		return entry, nil, false
+	}
+	entry.Key = data[:keyLen]
+	data = data[keyLen:]
+
+	if !hasValue {
+		return entry, data, true
+	}
+
+	if len(data) < 4 {
+		return entry, nil, false
+	}
+	valueLen := binary.BigEndian.Uint32(data)
+	data = data[4:]
+	if uint64(len(data)) < uint64(valueLen) {
+		return entry, nil, false
+	}
+	if entry.Kind == kindSet {
+		entry.Value = data[:valueLen]
+	}
+	data = data[valueLen:]
+
+	return entry, data, true
+}
+
+// What the manifest records about this file
+func (r *sstReader) meta() fileMeta {
+	return fileMeta{
+		name:     filepath.Base(r.file.Name()),
+		level:    r.level,
+		seq:      r.seq,
+		size:     r.size,
+		smallest: r.smallestKey,
+		largest:  r.largestKey,
+	}
+}
+
+// Whether key falls in the key range of this file
+func (r *sstReader) mayContain(key []byte) bool {
+	return r.entryCount > 0 && bytes.Compare(key, r.smallestKey) >= 0 && bytes.Compare(key, r.largestKey) <= 0
+}
+
+// Whether the key range of this file intersects [smallest, largest]
+func (r *sstReader) overlaps(smallest, largest []byte) bool {
+	return r.entryCount > 0 && bytes.Compare(r.largestKey, smallest) >= 0 && bytes.Compare(r.smallestKey, largest) <= 0
+}
+
+// Look for the newest entry of key numbered up to seq in the file. The
+// Bloom filter and the block index are kept in memory so the lookup
+// Reads at most a single block: the first one whose last key is >= key,
+// Which is then binary searched. Version 1 files have no index, their
+// Only block is searched the same way once sorted
+func (r *sstReader) get(key []byte, seq uint64) (entry, bool, error) {
+	if !r.mayContain(key) {
+		return entry{}, false, nil
+	}
+
+	if r.filter != nil && !r.filter.mayContain(key) {
+		r.filterNegatives.Add(1)
+		return entry{}, false, nil
+	}
+
+	entry, found, err := r.search(key, seq)
+	if err == nil && !found && r.filter != nil {
+		r.filterFalsePositives.Add(1)
+	}
+	return entry, found, err
+}
+
+// Find the newest version of key numbered up to seq. The versions of a
+// Key follow each other from the newest to the oldest and can go on in
+// The next blocks
+func (r *sstReader) search(key []byte, seq uint64) (entry, bool, error) {
+	it := r.NewIterator()
+	for it.Seek(key); it.Valid() && bytes.Equal(it.Entry().Key, key); it.Next() {
+		if entry := it.Entry(); entry.Seq <= seq {
+			return entry, true, nil
+		}
+	}
+	return entry{}, false, it.Err()
+}
+
+// Whether keys starting with prefix may be in the file. Only prefixes
+// Ending with the delimiter the file was written with can be ruled out
+func (r *sstReader) mayContainPrefix(prefix []byte) bool {
+	if r.prefixFilter == nil || len(prefix) == 0 || !bytes.HasSuffix(prefix, r.prefixDelimiter) {
+		return true
+	}
+	if r.prefixFilter.mayContain(prefix) {
+		return true
+	}
+	r.prefixFilterNegatives.Add(1)
+	return false
+}
+
+// Share of lookups for absent keys that the bloom filter failed to
+// Reject, among the lookups that were not ruled out by the key range
+func (r *sstReader) FalsePositiveRate() float64 {
+	negatives := r.filterNegatives.Load()
+	falsePositives := r.filterFalsePositives.Load()
+	if negatives+falsePositives == 0 {
+		return 0
+	}
+	return float64(falsePositives) / float64(negatives+falsePositives)
+}
+
+func (r *sstReader) markCorrupt(err error) {
+	err = fmt.Errorf("%s: %w", r.file.Name(), err)
+	r.corrupt.Store(&err)
+}
+
+// Why the file was found corrupt, nil while it is not
+func (r *sstReader) corruption() error {
+	if err := r.corrupt.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+func (r *sstReader) ref() {
+	r.refs.Add(1)
+}
+
+// Drop a reference to the file. The last one closes it, and removes it
+// As well when a compaction has replaced it
+func (r *sstReader) unref() error {
+	if r.refs.Add(-1) > 0 {
+		return nil
+	}
+
+	err := r.file.Close()
+	if r.obsolete.Load() {
+		if removeErr := os.Remove(r.file.Name()); err == nil {
+			err = removeErr
+		}
+	}
+	return err
+}
+
+func (r *sstReader) NewIterator() *sstIterator {
+	return &sstIterator{reader: r}
+}
+
+func (r *sstReader) Close() error {
+	return r.file.Close()
+}
+
+// An iterator that walks the entries of an sst file in key order, in both
+// Directions, one block at a time
+type sstIterator struct {
+	reader  *sstReader
+	blockID int
+	entries []entry
+	pos     int
+	err     error
+}
+
+func (it *sstIterator) SeekToFirst() {
+	it.err = nil
+	it.loadBlock(0)
+}
+
+// Position the iterator on the first entry whose key is >= key, only
+// The block that may hold it is read
+func (it *sstIterator) Seek(key []byte) {
+	it.err = nil
+
+	i := 0
+	if it.reader.version != legacyVersion {
+		i = sort.Search(len(it.reader.index), func(i int) bool {
+			return bytes.Compare(it.reader.index[i].lastKey, key) >= 0
+		})
+	}
+	it.loadBlock(i)
+
+	it.pos = sort.Search(len(it.entries), func(j int) bool {
+		return bytes.Compare(it.entries[j].Key, key) >= 0
+	})
+	if it.err == nil && it.pos >= len(it.entries) {
+		it.loadBlock(it.blockID + 1)
+	}
+}
+
+// Load the block with the given index, skipping empty blocks
+func (it *sstIterator) loadBlock(i int) {
+	it.entries, it.pos = nil, 0
+	for it.blockID = i; it.blockID < len(it.reader.index); it.blockID++ {
+		entries, err := it.reader.readBlock(it.blockID)
+		if err != nil {
+			it.err = err
+			return
+		}
+		if len(entries) > 0 {
+			it.entries = entries
+			return
+		}
+	}
+}
+
+func (it *sstIterator) SeekToLast() {
+	it.err = nil
+	it.loadPrevBlock(len(it.reader.index) - 1)
+}
+
+// Load the block with the given index or the closest non empty one
+// Before it, and position the iterator on its last entry
+func (it *sstIterator) loadPrevBlock(i int) {
+	it.entries, it.pos = nil, 0
+	for it.blockID = i; it.blockID >= 0; it.blockID-- {
+		entries, err := it.reader.readBlock(it.blockID)
+		if err != nil {
+			it.err = err
+			return
+		}
+		if len(entries) > 0 {
+			it.entries, it.pos = entries, len(entries)-1
+			return
+		}
+	}
+}
+
+func (it *sstIterator) Valid() bool {
+	return it.err == nil && it.pos < len(it.entries)
+}
+
+func (it *sstIterator) Next() {
+	it.pos++
+	if it.pos >= len(it.entries) {
+		it.loadBlock(it.blockID + 1)
+	}
+}
+
+func (it *sstIterator) Prev() {
+	it.pos--
+	if it.pos < 0 {
+		it.loadPrevBlock(it.blockID - 1)
+	}
+}
+
+func (it *sstIterator) Entry() entry {
+	return it.entries[it.pos]
+}
+
+// The error that stopped the iteration, if any
+func (it *sstIterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,357 @@
+package zikodb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Write the given entries to a fresh sst file and open it for reading
+func writeTestSST(t *testing.T, entries []entry) *sstReader {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "test.sst")
+	sst, err := newSSTFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if err := sst.Add(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sst.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	sst.Close()
+
+	reader, err := openSST(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { reader.Close() })
+	return reader
+}
+
+func testEntries(n int) []entry {
+	entries := make([]entry, n)
+	for i := range entries {
+		entries[i] = entry{
+			Kind:  kindSet,
+			Seq:   uint64(i + 1),
+			Key:   []byte(fmt.Sprintf("key%05d", i)),
+			Value: []byte(fmt.Sprintf("value%d", i)),
+		}
+		if i%7 == 0 {
+			entries[i] = entry{Kind: kindDelete, Seq: entries[i].Seq, Key: entries[i].Key}
+		}
+	}
+	return entries
+}
+
+func TestSSTRoundTrip(t *testing.T) {
+	entries := testEntries(2000)
+	reader := writeTestSST(t, entries)
+
+	if len(reader.index) < 2 {
+		t.Errorf("Expected several data blocks, got %d", len(reader.index))
+	}
+	if reader.entryCount != uint32(len(entries)) {
+		t.Errorf("Footer entry count is %d, expected %d", reader.entryCount, len(entries))
+	}
+	if string(reader.smallestKey) != "key00000" || string(reader.largestKey) != "key01999" {
+		t.Errorf("Wrong key range %q - %q", reader.smallestKey, reader.largestKey)
+	}
+
+	i := 0
+	it := reader.NewIterator()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		entry := it.Entry()
+		if entry.Kind != entries[i].Kind || entry.Seq != entries[i].Seq || !bytes.Equal(entry.Key, entries[i].Key) || !bytes.Equal(entry.Value, entries[i].Value) {
+			t.Fatalf("Entry %d is %v, expected %v", i, entry, entries[i])
+		}
+		i++
+	}
+	if it.Err() != nil || i != len(entries) {
+		t.Errorf("Iterated over %d entries, err %v", i, it.Err())
+	}
+}
+
+func TestSSTGet(t *testing.T) {
+	entries := testEntries(2000)
+	reader := writeTestSST(t, entries)
+
+	for _, expected := range entries {
+		entry, found, err := reader.get(expected.Key, maxSequence)
+		if err != nil || !found {
+			t.Fatalf("Get(%s) = %v %v", expected.Key, found, err)
+		}
+		if entry.Kind != expected.Kind || !bytes.Equal(entry.Value, expected.Value) {
+			t.Fatalf("Get(%s) returned %v, expected %v", expected.Key, entry, expected)
+		}
+	}
+
+	for _, key := range []string{"", "a", "key00000a", "key01999a", "zzz"} {
+		if _, found, _ := reader.get([]byte(key), maxSequence); found {
+			t.Errorf("Get(%q) should not find anything", key)
+		}
+	}
+}
+
+func TestTableSetNewestWins(t *testing.T) {
+	set := &tableSet{}
+	set.levels[0] = append(set.levels[0], writeTestSST(t, []entry{
+		{Kind: kindSet, Key: []byte("a"), Value: []byte("old")},
+		{Kind: kindSet, Key: []byte("b"), Value: []byte("old")},
+	}))
+	set.levels[0] = append(set.levels[0], writeTestSST(t, []entry{
+		{Kind: kindSet, Key: []byte("a"), Value: []byte("new")},
+		{Kind: kindDelete, Key: []byte("b")},
+	}))
+
+	if entry, _, _ := set.get([]byte("a"), maxSequence); string(entry.Value) != "new" {
+		t.Errorf("Get(a) returned %q, expected the newest value", entry.Value)
+	}
+	if entry, found, _ := set.get([]byte("b"), maxSequence); !found || !entry.IsDeleted() {
+		t.Errorf("Get(b) should find the tombstone of the newest file")
+	}
+}
+
+func TestTableSetHighestSequenceWins(t *testing.T) {
+	set := &tableSet{}
+	set.levels[0] = append(set.levels[0], writeTestSST(t, []entry{
+		{Kind: kindSet, Seq: 9, Key: []byte("a"), Value: []byte("new")},
+	}))
+	set.levels[0] = append(set.levels[0], writeTestSST(t, []entry{
+		{Kind: kindSet, Seq: 4, Key: []byte("a"), Value: []byte("old")},
+	}))
+
+	if entry, _, _ := set.get([]byte("a"), maxSequence); string(entry.Value) != "new" {
+		t.Errorf("Get(a) returned %q, expected the value with the highest sequence number", entry.Value)
+	}
+}
+
+func TestSSTRejectsUnsortedKeys(t *testing.T) {
+	sst, err := newSSTFile(filepath.Join(t.TempDir(), "test.sst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sst.Close()
+
+	sst.Add(entry{Kind: kindSet, Key: []byte("b")})
+	if err := sst.Add(entry{Kind: kindSet, Key: []byte("a")}); err == nil {
+		t.Errorf("Adding a smaller key should fail")
+	}
+}
+
+// The empty key sorts first, the key range of the file must still start
+// With it
+func TestSSTEmptyKey(t *testing.T) {
+	reader := writeTestSST(t, []entry{
+		{Kind: kindSet, Key: nil, Value: []byte("1")},
+		{Kind: kindSet, Key: []byte("a"), Value: []byte("2")},
+	})
+
+	for _, key := range [][]byte{nil, {}} {
+		if entry, ok, err := reader.get(key, maxSequence); err != nil || !ok || string(entry.Value) != "1" {
+			t.Errorf("Get(%q) = %q %v %v", key, entry.Value, ok, err)
+		}
+	}
+
+	sst, err := newSSTFile(filepath.Join(t.TempDir(), "test.sst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sst.Close()
+
+	sst.Add(entry{Kind: kindSet, Key: nil})
+	if err := sst.Add(entry{Kind: kindSet, Key: []byte{}}); err == nil {
+		t.Errorf("Adding the empty key twice should fail")
+	}
+}
+
+func TestSSTIteratorBackward(t *testing.T) {
+	entries := testEntries(2000)
+	reader := writeTestSST(t, entries)
+	if len(reader.index) < 2 {
+		t.Fatalf("Expected several blocks, got %d", len(reader.index))
+	}
+
+	it := reader.NewIterator()
+	i := len(entries) - 1
+	for it.SeekToLast(); it.Valid(); it.Prev() {
+		if !bytes.Equal(it.Entry().Key, entries[i].Key) {
+			t.Fatalf("Prev returned %s, expected %s", it.Entry().Key, entries[i].Key)
+		}
+		i--
+	}
+	if err := it.Err(); err != nil || i != -1 {
+		t.Errorf("Stopped %d entries before the first one with error %v", i+1, err)
+	}
+}
+
+func TestSSTPrefixFilter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.sst")
+	sst, err := newSSTFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sst.prefixDelimiter = []byte(":")
+	for _, key := range []string{"order:9", "user:1:name", "user:1:profile", "user:2:profile"} {
+		sst.Add(entry{Kind: kindSet, Seq: 1, Key: []byte(key), Value: []byte("v")})
+	}
+	if err := sst.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	sst.Close()
+
+	reader, err := openSST(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	for _, prefix := range []string{"order:", "user:", "user:1:", "user:2:", "use", "user:1:n"} {
+		if !reader.mayContainPrefix([]byte(prefix)) {
+			t.Errorf("The prefix filter rules out %q", prefix)
+		}
+	}
+	for _, prefix := range []string{"post:", "user:3:"} {
+		if reader.mayContainPrefix([]byte(prefix)) {
+			t.Errorf("The prefix filter should rule out %q", prefix)
+		}
+	}
+}
+
+func TestSSTDetectsCorruptBlock(t *testing.T) {
+	reader := writeTestSST(t, testEntries(100))
+
+	path := reader.file.Name()
+	data, _ := os.ReadFile(path)
+	data[reader.index[0].offset+10] ^= 0xff
+	os.WriteFile(path, data, 0644)
+
+	corrupt, err := openSST(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer corrupt.Close()
+
+	if _, _, err := corrupt.get([]byte("key00001"), maxSequence); err == nil {
+		t.Errorf("Reading a corrupt block should fail")
+	}
+}
+
+// Version 1 files list every set entry before the del entries
+// And only carry the keys with the smallest and largest lengths
+func TestSSTReadsLegacyVersion(t *testing.T) {
+	var data bytes.Buffer
+	binary.Write(&data, binary.BigEndian, magicNumber)
+	binary.Write(&data, binary.BigEndian, uint32(3))
+	binary.Write(&data, binary.BigEndian, uint32(1))
+	data.WriteString("a")
+	binary.Write(&data, binary.BigEndian, uint32(3))
+	data.WriteString("ccc")
+	binary.Write(&data, binary.BigEndian, legacyVersion)
+
+	data.WriteString("S")
+	binary.Write(&data, binary.BigEndian, uint32(3))
+	data.WriteString("ccc")
+	binary.Write(&data, binary.BigEndian, uint32(1))
+	data.WriteString("3")
+	data.WriteString("S")
+	binary.Write(&data, binary.BigEndian, uint32(1))
+	data.WriteString("a")
+	binary.Write(&data, binary.BigEndian, uint32(1))
+	data.WriteString("1")
+	data.WriteString("D")
+	binary.Write(&data, binary.BigEndian, uint32(2))
+	data.WriteString("bb")
+	binary.Write(&data, binary.BigEndian, crc32.ChecksumIEEE(data.Bytes()))
+
+	path := filepath.Join(t.TempDir(), "legacy.sst")
+	os.WriteFile(path, data.Bytes(), 0644)
+
+	reader, err := openSST(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	if entry, found, err := reader.get([]byte("ccc"), maxSequence); err != nil || !found || string(entry.Value) != "3" {
+		t.Errorf("Get(ccc) = %v %v %v", entry, found, err)
+	}
+	if entry, found, _ := reader.get([]byte("bb"), maxSequence); !found || !entry.IsDeleted() {
+		t.Errorf("Get(bb) should find a tombstone")
+	}
+	if _, found, _ := reader.get([]byte("dddd"), maxSequence); found {
+		t.Errorf("Get(dddd) should not find anything")
+	}
+}
+
+func TestSSTChecksumMatchesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	sst, err := newSSTFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range testEntries(1000) {
+		sst.Add(entry)
+	}
+	if err := sst.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	sst.Close()
+
+	// The checksum computed while writing is the crc32c of the whole file
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := data[:len(data)-4]
+	if stored := binary.BigEndian.Uint32(data[len(body):]); stored != crc32.Checksum(body, crc32.MakeTable(crc32.Castagnoli)) {
+		t.Errorf("Stored checksum %08x is not the crc32c of the file", stored)
+	}
+
+	data[len(data)/2] ^= 0xff
+	if err := verifyChecksumStream(bytes.NewReader(data), int64(len(data)), version); !errors.Is(err, ErrCorruptSST) {
+		t.Errorf("verifyChecksumStream returned %v for a flipped byte", err)
+	}
+}
+
+func TestSSTFileAppearsWhenFinished(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	sst, err := newSSTFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range testEntries(10) {
+		sst.Add(entry)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("The sst file should not be visible before Finish")
+	}
+	if err := sst.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	sst.Close()
+	if _, err := os.Stat(path + tempFileSuffix); !os.IsNotExist(err) {
+		t.Errorf("The temporary file should be renamed by Finish")
+	}
+
+	// An abandoned file leaves nothing behind
+	abandoned, err := newSSTFile(filepath.Join(filepath.Dir(path), "000002.sst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	abandoned.Add(testEntries(1)[0])
+	abandoned.Close()
+	if names, _ := os.ReadDir(filepath.Dir(path)); len(names) != 1 {
+		t.Errorf("Expected only the finished file, got %v", names)
+	}
+}
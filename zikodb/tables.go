@@ -0,0 +1,421 @@
+package zikodb
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Number of levels, the last one is never compacted further
+const numLevels = 7
+
+// The sst files being served, kept open so that their index blocks
+// Stay in memory. Level 0 holds the flushed files, which overlap and
+// Are ordered from oldest to newest by sequence number. Deeper levels
+// Are filled by the leveled compaction, their files do not overlap and
+// Are ordered by key. A level is newer than all the levels below it.
+// The sequence number of a file is the highest sequence number of its
+// Entries.
+//
+// The set of live files and their levels is recorded in the manifest,
+// Any other sst file found in the directory is a leftover of a crash
+type tableSet struct {
+	mu             sync.RWMutex
+	dir            string
+	levels         [numLevels][]*sstReader
+	manifest       *manifest
+	nextFileNumber uint64
+	lastSequence   uint64
+
+	options          CompactionOptions
+	logger           *log.Logger
+	compactionSignal chan struct{}
+
+	// Where the next leveled compaction of each level starts
+	compactPointer [numLevels][]byte
+
+	// Delimiter of the prefix filters of the files written from now on
+	// And the size of their bloom filters, 0 writes no filter
+	prefixDelimiter []byte
+	bloomBitsPerKey int
+
+	// Compactions keep the versions of the keys these still see
+	snapshots *snapshotList
+
+	scrubMu    sync.Mutex
+	scrubStats ScrubStats
+}
+
+func openTableSet(dir string, options CompactionOptions, logger *log.Logger) (*tableSet, error) {
+	s := &tableSet{
+		options:          options,
+		logger:           logger,
+		compactionSignal: make(chan struct{}, 1),
+		bloomBitsPerKey:  defaultBloomBitsPerKey,
+		snapshots:        &snapshotList{},
+	}
+	if err := s.load(dir); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Allocate the name of a new sst file, file numbers are never reused
+func (s *tableSet) newTableFile() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	number := s.nextFileNumber
+	s.nextFileNumber++
+	return filepath.Join(s.dir, fmt.Sprintf("%06d.sst", number))
+}
+
+// Open the live sst files of dir as recorded by the manifest. A
+// Directory without a manifest comes from an older version, all its
+// Sst files are taken as live in name order. Files that are not live
+// Are removed, then the manifest is rewritten as a single edit
+func (s *tableSet) load(dir string) error {
+	live, nextFileNumber, lastSequence, err := replayManifest(dir, s.logger)
+	if os.IsNotExist(err) {
+		live, nextFileNumber, lastSequence, err = s.importLegacyTables(dir)
+	}
+	if err != nil {
+		return err
+	}
+
+	sstFiles, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.dir = dir
+	s.nextFileNumber = nextFileNumber
+	if s.nextFileNumber == 0 {
+		s.nextFileNumber = 1
+	}
+
+	s.lastSequence = lastSequence
+
+	for _, sstFile := range sstFiles {
+		name := sstFile.Name()
+		if filepath.Ext(name) == tempFileSuffix {
+			s.logger.Println("Removing unfinished file:", name)
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if _, ok := live[name]; !ok && filepath.Ext(name) == ".sst" {
+			s.logger.Println("Removing SST file missing from the manifest:", name)
+			os.Remove(filepath.Join(dir, name))
+		}
+	}
+
+	// Live files that cannot be opened are quarantined. Missing ones
+	// Stay in the manifest so that their loss is reported on every start
+	var unopened []fileMeta
+	for _, meta := range live {
+		sstFilePath := filepath.Join(dir, meta.name)
+		sst, err := openSST(sstFilePath)
+		if err != nil {
+			s.logger.Printf("Error opening SST file %s: %v\n", sstFilePath, err)
+			if _, statErr := os.Stat(sstFilePath); statErr == nil {
+				if err := quarantineFile(dir, meta.name); err != nil {
+					return err
+				}
+				s.logger.Println("Quarantined corrupt SST file:", meta.name)
+				continue
+			}
+			unopened = append(unopened, meta)
+			continue
+		}
+		sst.level = meta.level
+		sst.seq = meta.seq
+		s.levels[sst.level] = append(s.levels[sst.level], sst)
+	}
+
+	count := 0
+	for level := range s.levels {
+		s.sortLevel(level)
+		count += len(s.levels[level])
+	}
+
+	snapshot := s.snapshot()
+	snapshot.added = append(snapshot.added, unopened...)
+	if s.manifest, err = createManifest(dir, snapshot); err != nil {
+		return err
+	}
+
+	s.logger.Printf("Loaded %d SST files\n", count)
+	return nil
+}
+
+// Build the live set of a directory that has no manifest yet. Its files
+// All belong to level 0 and are numbered in name order, so the last
+// Sequence number is their count
+func (s *tableSet) importLegacyTables(dir string) (map[string]fileMeta, uint64, uint64, error) {
+	sstFiles, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	live := make(map[string]fileMeta)
+	nextFileNumber := uint64(1)
+
+	for _, sstFile := range sstFiles {
+		name := sstFile.Name()
+		if filepath.Ext(name) != ".sst" {
+			continue
+		}
+
+		var number uint64
+		if _, err := fmt.Sscanf(name, "%d.sst", &number); err == nil && number >= nextFileNumber {
+			nextFileNumber = number + 1
+		}
+
+		live[name] = fileMeta{
+			name: name,
+			seq:  uint64(len(live) + 1),
+		}
+	}
+
+	// Sequence numbers of the imported files stay below the
+	// Ones of the files flushed from now on
+	if next := uint64(len(live) + 1); next > nextFileNumber {
+		nextFileNumber = next
+	}
+
+	s.logger.Printf("No manifest found, importing %d SST files\n", len(live))
+	return live, nextFileNumber, uint64(len(live)), nil
+}
+
+// Keep level 0 in sequence order and deeper levels in key order,
+// The caller must hold the lock
+func (s *tableSet) sortLevel(level int) {
+	files := s.levels[level]
+	sort.SliceStable(files, func(i, j int) bool {
+		if level == 0 {
+			return files[i].seq < files[j].seq
+		}
+		return bytes.Compare(files[i].smallestKey, files[j].smallestKey) < 0
+	})
+}
+
+// An edit that adds every live file, the caller must hold the lock
+func (s *tableSet) snapshot() versionEdit {
+	edit := versionEdit{nextFileNumber: s.nextFileNumber, lastSequence: s.lastSequence}
+	for _, files := range s.levels {
+		for _, sst := range files {
+			edit.added = append(edit.added, sst.meta())
+		}
+	}
+	return edit
+}
+
+// Record a freshly written sst file in the manifest, and serve it
+// As the newest file of level 0
+func (s *tableSet) add(filename string, seq uint64) error {
+	sst, err := openSST(filename)
+	if err != nil {
+		return err
+	}
+	sst.seq = seq
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lastSequence := s.lastSequence
+	if seq > lastSequence {
+		lastSequence = seq
+	}
+
+	edit := versionEdit{
+		nextFileNumber: s.nextFileNumber,
+		lastSequence:   lastSequence,
+		added:          []fileMeta{sst.meta()},
+	}
+	if err := s.manifest.apply(edit); err != nil {
+		sst.Close()
+		return err
+	}
+	s.lastSequence = lastSequence
+
+	s.levels[0] = append(s.levels[0], sst)
+	s.sortLevel(0)
+	return nil
+}
+
+// Look for key in every file of a level, the entry with the highest
+// Sequence number decides whether the key is set or deleted. Entries
+// Without sequence numbers are ordered by the files holding them, from
+// The newest file to the oldest one. Deeper levels are only looked at
+// When the upper ones do not have the key. Only the entries numbered up
+// To seq are looked at
+func (s *tableSet) get(key []byte, seq uint64) (entry, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, level := range s.levels {
+		var newest entry
+		found := false
+		for i := len(level) - 1; i >= 0; i-- {
+			got, ok, err := level[i].get(key, seq)
+			if err != nil {
+				return entry{}, false, err
+			}
+			if ok && (!found || got.Seq > newest.Seq) {
+				newest, found = got, true
+			}
+		}
+		if found {
+			return newest, true, nil
+		}
+	}
+
+	return entry{}, false, nil
+}
+
+// Iterators over the files that may hold keys in [start, end), from the
+// Newest file to the oldest. A nil start or end leaves that side open.
+// Files whose prefix filter rules out prefix are left out as well. The
+// Files are pinned until the caller unrefs them
+func (s *tableSet) iterators(start, end []byte, prefix []byte) ([]entryIterator, []*sstReader) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var iters []entryIterator
+	var files []*sstReader
+	for _, level := range s.levels {
+		for i := len(level) - 1; i >= 0; i-- {
+			sst := level[i]
+			if sst.entryCount == 0 ||
+				start != nil && bytes.Compare(sst.largestKey, start) < 0 ||
+				end != nil && bytes.Compare(sst.smallestKey, end) >= 0 ||
+				!sst.mayContainPrefix(prefix) {
+				continue
+			}
+			sst.ref()
+			iters = append(iters, sst.NewIterator())
+			files = append(files, sst)
+		}
+	}
+	return iters, files
+}
+
+// Total size of the files of a level, the caller must hold the lock
+func (s *tableSet) levelSize(level int) int64 {
+	var size int64
+	for _, sst := range s.levels[level] {
+		size += sst.size
+	}
+	return size
+}
+
+// Files of a level whose key range intersects [smallest, largest],
+// The caller must hold the lock
+func (s *tableSet) overlapping(level int, smallest, largest []byte) []*sstReader {
+	var files []*sstReader
+	for _, sst := range s.levels[level] {
+		if sst.overlaps(smallest, largest) {
+			files = append(files, sst)
+		}
+	}
+	return files
+}
+
+// Record the removal of some files and the addition of others to
+// Level in a single manifest edit, then apply it to the in-memory set
+func (s *tableSet) replace(removed []*sstReader, level int, added []*sstReader) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	edit := versionEdit{nextFileNumber: s.nextFileNumber, lastSequence: s.lastSequence}
+	for _, sst := range added {
+		sst.level = level
+		edit.added = append(edit.added, sst.meta())
+	}
+	for _, sst := range removed {
+		edit.deleted = append(edit.deleted, filepath.Base(sst.file.Name()))
+	}
+	if err := s.manifest.apply(edit); err != nil {
+		return err
+	}
+
+	gone := make(map[*sstReader]bool, len(removed))
+	for _, sst := range removed {
+		gone[sst] = true
+	}
+
+	for i := range s.levels {
+		var kept []*sstReader
+		for _, sst := range s.levels[i] {
+			if !gone[sst] {
+				kept = append(kept, sst)
+			}
+		}
+		s.levels[i] = kept
+	}
+
+	s.levels[level] = append(s.levels[level], added...)
+	s.sortLevel(level)
+	return nil
+}
+
+// Statistics of a single sst file
+type SSTStats struct {
+	File                 string  `json:"file"`
+	Level                int     `json:"level"`
+	Size                 int64   `json:"size"`
+	Entries              uint32  `json:"entries"`
+	HasFilter            bool    `json:"has_filter"`
+	FilterNegatives      uint64  `json:"filter_negatives"`
+	FilterFalsePositives uint64  `json:"filter_false_positives"`
+	FalsePositiveRate    float64 `json:"false_positive_rate"`
+	HasPrefixFilter      bool    `json:"has_prefix_filter"`
+	PrefixFilterSkips    uint64  `json:"prefix_filter_skips"`
+	Corrupt              bool    `json:"corrupt"`
+}
+
+func (s *tableSet) Stats() []SSTStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var stats []SSTStats
+	for level, files := range s.levels {
+		for _, sst := range files {
+			stats = append(stats, SSTStats{
+				File:                 filepath.Base(sst.file.Name()),
+				Level:                level,
+				Size:                 sst.size,
+				Entries:              sst.entryCount,
+				HasFilter:            sst.filter != nil,
+				FilterNegatives:      sst.filterNegatives.Load(),
+				FilterFalsePositives: sst.filterFalsePositives.Load(),
+				FalsePositiveRate:    sst.FalsePositiveRate(),
+				HasPrefixFilter:      sst.prefixFilter != nil,
+				PrefixFilterSkips:    sst.prefixFilterNegatives.Load(),
+				Corrupt:              sst.corruption() != nil,
+			})
+		}
+	}
+	return stats
+}
+
+// Close every sst file and the manifest, the files still read by an
+// Iterator are closed along with it
+func (s *tableSet) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, files := range s.levels {
+		for _, sst := range files {
+			sst.unref()
+		}
+	}
+	return s.manifest.Close()
+}
@@ -0,0 +1,601 @@
+package zikodb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type walEntry struct {
+	Action byte
+	Seq    uint64
+	Key    []byte
+	Value  []byte
+}
+
+// Every record is framed with its length and a crc32c of its payload so
+// That a record torn by a crash, or damaged on disk, is detected:
+//
+//	'F' u8 | length u32 | crc32c u32 | seq u64 | action u8 | keyLen u32 | key | valueLen u32 | value
+//
+// The entries of a write batch share a single record, so a crash leaves
+// Either all of them or none. They are numbered from seq on:
+//
+//	'B' u8 | length u32 | crc32c u32 | seq u64 | count u32 | count * (action u8 | keyLen u32 | key | valueLen u32 | value)
+//
+// Wals written by older versions hold unframed records, which start
+// Directly with their action or with '#' and a sequence number:
+//
+//	'#' u8 | seq u64 | action u8 | keyLen u32 | key | valueLen u32 | value
+const (
+	walFramedRecord    = byte('F')
+	walBatchRecord     = byte('B')
+	walSequencedRecord = byte('#')
+
+	walFrameHeaderSize = 9
+)
+
+var walChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+var ErrCorruptWAL = errors.New("zikodb: corrupt wal")
+
+// Returned by readWAL along with the entries before the first record that
+// Is torn or fails its checksum, nothing after that record is replayed
+type walCorruptionError struct {
+	Filename string
+
+	// Where the bad record starts and how many bytes are left from there
+	Offset    int64
+	Discarded int64
+
+	Reason string
+}
+
+func (e *walCorruptionError) Error() string {
+	return fmt.Sprintf("zikodb: corrupt wal %s at offset %d, %d bytes discarded: %s", e.Filename, e.Offset, e.Discarded, e.Reason)
+}
+
+func (e *walCorruptionError) Unwrap() error {
+	return ErrCorruptWAL
+}
+
+// The wal is a directory of numbered segments. Each memtable logs to its
+// Own segment, which is deleted once the memtable is recorded in an sst
+// File. The segments left after a crash are replayed in order.
+//
+// Writes are group committed: a writer queues its record then takes the
+// File lock, whoever holds it writes every queued record with a single
+// Write and, when syncing, a single fsync. Writers that queued while a
+// Commit was in progress are usually committed by the next one at once
+type wal struct {
+	dir string
+
+	// Held while the file is written, synced or replaced
+	mu       sync.Mutex
+	file     *os.File
+	number   uint64
+	syncMode SyncMode
+
+	// Size of the segment up to the end of its last good commit, and
+	// The error every write fails with once torn bytes cannot be cut
+	// Off after a failed commit
+	size   int64
+	failed error
+
+	// Segments found when the wal was opened, oldest first, they are
+	// Replayed by flushWAL
+	recovered []string
+
+	queueMu sync.Mutex
+	queue   []*walWrite
+
+	// Number of records written and of fsyncs, reported in the stats
+	writes atomic.Uint64
+	syncs  atomic.Uint64
+}
+
+type walWrite struct {
+	record []byte
+	done   chan error
+}
+
+const walSegmentSuffix = ".log"
+
+// Before segments the wal was a single file, it is older than any segment
+const legacyWALName = "wal"
+
+func walSegmentName(number uint64) string {
+	return fmt.Sprintf("%06d%s", number, walSegmentSuffix)
+}
+
+// Number of a segment file name, ok is false for other files
+func parseWALSegmentName(name string) (number uint64, ok bool) {
+	if !strings.HasSuffix(name, walSegmentSuffix) {
+		return 0, false
+	}
+	number, err := strconv.ParseUint(strings.TrimSuffix(name, walSegmentSuffix), 10, 64)
+	return number, err == nil
+}
+
+// Open the wal stored in dir without writing to it, flushWAL starts the
+// New segment once the existing ones are replayed. A replay that fails
+// Then leaves the directory as it was
+func openWAL(dir string) (*wal, error) {
+	recovered, last, err := walSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &wal{dir: dir, recovered: recovered, number: last + 1}, nil
+}
+
+// The wal files of dir in replay order, the legacy one first, along
+// With the number of the last segment
+func walSegments(dir string) ([]string, uint64, error) {
+	names, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var files []string
+	if _, err := os.Stat(filepath.Join(dir, legacyWALName)); err == nil {
+		files = append(files, filepath.Join(dir, legacyWALName))
+	}
+
+	var numbers []uint64
+	for _, name := range names {
+		if number, ok := parseWALSegmentName(name.Name()); ok {
+			numbers = append(numbers, number)
+		}
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+
+	var last uint64
+	for _, number := range numbers {
+		files = append(files, filepath.Join(dir, walSegmentName(number)))
+		last = number
+	}
+	return files, last, nil
+}
+
+func (w *wal) createSegment(number uint64) (*os.File, error) {
+	file, err := os.OpenFile(filepath.Join(w.dir, walSegmentName(number)), os.O_APPEND|os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syncDir(w.dir); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// Write data to the wal file. It returns once the record is written and,
+// With SyncAlways, synced along with the records committed with it
+func (w *wal) Write(entry *walEntry) error {
+	return w.write(encodeWALRecord(entry))
+}
+
+// Write the entries of a batch as a single record, they must be numbered
+// One after the other. A batch of one entry is written as a plain record
+func (w *wal) WriteBatch(entries []walEntry) error {
+	if len(entries) == 1 {
+		return w.Write(&entries[0])
+	}
+	return w.write(encodeWALBatch(entries))
+}
+
+func (w *wal) write(record []byte) error {
+	write := &walWrite{
+		record: record,
+		done:   make(chan error, 1),
+	}
+
+	w.queueMu.Lock()
+	w.queue = append(w.queue, write)
+	w.queueMu.Unlock()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// The previous holder of the lock may have committed our record
+	select {
+	case err := <-write.done:
+		return err
+	default:
+	}
+
+	w.queueMu.Lock()
+	batch := w.queue
+	w.queue = nil
+	w.queueMu.Unlock()
+
+	err := w.commit(batch)
+	for _, queued := range batch {
+		queued.done <- err
+	}
+	return <-write.done
+}
+
+// Write the records of a group, the caller must hold the file lock. A
+// Failed write or sync leaves the segment cut back to its last good
+// Commit, the replay would otherwise stop at the torn bytes and lose
+// The records written after them
+func (w *wal) commit(batch []*walWrite) error {
+	if w.failed != nil {
+		return w.failed
+	}
+
+	size := 0
+	for _, write := range batch {
+		size += len(write.record)
+	}
+	records := make([]byte, 0, size)
+	for _, write := range batch {
+		records = append(records, write.record...)
+	}
+
+	if _, err := w.file.Write(records); err != nil {
+		return w.rollback(err)
+	}
+	if w.syncMode == SyncAlways {
+		if err := w.sync(); err != nil {
+			return w.rollback(err)
+		}
+	}
+	w.size += int64(len(records))
+	w.writes.Add(uint64(len(batch)))
+	return nil
+}
+
+// Cut off what a failed commit may have left in the segment. When that
+// Fails too the wal fails every write from then on
+func (w *wal) rollback(err error) error {
+	if truncateErr := w.file.Truncate(w.size); truncateErr != nil {
+		w.failed = fmt.Errorf("zikodb: wal failed after %v: %w", err, truncateErr)
+	}
+	return err
+}
+
+// Flush the written records to stable storage
+func (w *wal) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.sync()
+}
+
+func (w *wal) sync() error {
+	w.syncs.Add(1)
+	return w.file.Sync()
+}
+
+func encodeWALRecord(entry *walEntry) []byte {
+	record := make([]byte, walFrameHeaderSize, walFrameHeaderSize+8+walEntrySize(entry))
+	record[0] = walFramedRecord
+	record = binary.BigEndian.AppendUint64(record, entry.Seq)
+	record = appendWALEntry(record, entry)
+	return frameWALRecord(record)
+}
+
+func encodeWALBatch(entries []walEntry) []byte {
+	size := walFrameHeaderSize + 8 + 4
+	for i := range entries {
+		size += walEntrySize(&entries[i])
+	}
+
+	record := make([]byte, walFrameHeaderSize, size)
+	record[0] = walBatchRecord
+	record = binary.BigEndian.AppendUint64(record, entries[0].Seq)
+	record = binary.BigEndian.AppendUint32(record, uint32(len(entries)))
+	for i := range entries {
+		record = appendWALEntry(record, &entries[i])
+	}
+	return frameWALRecord(record)
+}
+
+func walEntrySize(entry *walEntry) int {
+	return 1 + 4 + len(entry.Key) + 4 + len(entry.Value)
+}
+
+func appendWALEntry(record []byte, entry *walEntry) []byte {
+	record = append(record, entry.Action)
+	record = binary.BigEndian.AppendUint32(record, uint32(len(entry.Key)))
+	record = append(record, entry.Key...)
+	record = binary.BigEndian.AppendUint32(record, uint32(len(entry.Value)))
+	return append(record, entry.Value...)
+}
+
+// Fill in the length and checksum of the payload that follows the header
+func frameWALRecord(record []byte) []byte {
+	payload := record[walFrameHeaderSize:]
+	binary.BigEndian.PutUint32(record[1:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[5:], crc32.Checksum(payload, walChecksumTable))
+	return record
+}
+
+// Read the entries from the wal file. Reading stops at the first torn or
+// Corrupt record, the entries before it are returned with a
+// *walCorruptionError
+func readWAL(filename string) ([]walEntry, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []walEntry
+	offset := 0
+	for offset < len(data) {
+		record, n, reason := decodeWALRecord(data[offset:])
+		if reason != "" {
+			return entries, &walCorruptionError{
+				Filename:  filename,
+				Offset:    int64(offset),
+				Discarded: int64(len(data) - offset),
+				Reason:    reason,
+			}
+		}
+		entries = append(entries, record...)
+		offset += n
+	}
+
+	return entries, nil
+}
+
+// Decode the record at the start of data, which holds several entries
+// For a batch, and return its size or why it cannot be decoded. Lengths
+// Are checked against the data left so that a garbage length never turns
+// Into a huge allocation
+func decodeWALRecord(data []byte) ([]walEntry, int, string) {
+	switch data[0] {
+	case walFramedRecord, walBatchRecord:
+		if len(data) < walFrameHeaderSize {
+			return nil, 0, "truncated record header"
+		}
+		length := binary.BigEndian.Uint32(data[1:])
+		checksum := binary.BigEndian.Uint32(data[5:])
+		if uint64(len(data)-walFrameHeaderSize) < uint64(length) {
+			return nil, 0, "truncated record"
+		}
+		payload := data[walFrameHeaderSize : walFrameHeaderSize+int(length)]
+		if crc32.Checksum(payload, walChecksumTable) != checksum {
+			return nil, 0, "checksum mismatch"
+		}
+		if len(payload) < 8 {
+			return nil, 0, "record too short"
+		}
+		seq := binary.BigEndian.Uint64(payload)
+
+		if data[0] == walFramedRecord {
+			entry, n, reason := decodeWALEntry(payload[8:], seq)
+			if reason == "" && n != len(payload)-8 {
+				reason = "record length does not match its entry"
+			}
+			return []walEntry{entry}, walFrameHeaderSize + int(length), reason
+		}
+		entries, reason := decodeWALBatch(payload[8:], seq)
+		return entries, walFrameHeaderSize + int(length), reason
+	case walSequencedRecord:
+		if len(data) < 9 {
+			return nil, 0, "truncated record"
+		}
+		entry, n, reason := decodeWALEntry(data[9:], binary.BigEndian.Uint64(data[1:]))
+		return []walEntry{entry}, 9 + n, reason
+	default:
+		entry, n, reason := decodeWALEntry(data, 0)
+		return []walEntry{entry}, n, reason
+	}
+}
+
+// Decode count u32 followed by the entries of a batch numbered from seq
+func decodeWALBatch(data []byte, seq uint64) ([]walEntry, string) {
+	if len(data) < 4 {
+		return nil, "record too short"
+	}
+	count := binary.BigEndian.Uint32(data)
+	offset := 4
+
+	// Every entry takes at least 9 bytes
+	if uint64(count)*9 > uint64(len(data)-offset) {
+		return nil, "batch count does not match its entries"
+	}
+	entries := make([]walEntry, 0, count)
+	for i := uint32(0); i < count; i++ {
+		entry, n, reason := decodeWALEntry(data[offset:], seq+uint64(i))
+		if reason != "" {
+			return nil, reason
+		}
+		entries = append(entries, entry)
+		offset += n
+	}
+	if offset != len(data) {
+		return nil, "record length does not match its entries"
+	}
+	return entries, ""
+}
+
+// Decode action | keyLen u32 | key | valueLen u32 | value
+func decodeWALEntry(data []byte, seq uint64) (walEntry, int, string) {
+	if len(data) < 1 {
+		return walEntry{}, 0, "truncated record"
+	}
+	action := data[0]
+	if action != byte(kindSet) && action != byte(kindDelete) {
+		return walEntry{}, 0, fmt.Sprintf("unknown action %d", action)
+	}
+
+	key, n := readWALBytes(data[1:])
+	if n < 0 {
+		return walEntry{}, 0, "truncated record"
+	}
+	offset := 1 + n
+	value, n := readWALBytes(data[offset:])
+	if n < 0 {
+		return walEntry{}, 0, "truncated record"
+	}
+	offset += n
+
+	return walEntry{Action: action, Seq: seq, Key: key, Value: value}, offset, ""
+}
+
+// Read a length prefixed byte string, n is -1 when data is too short
+func readWALBytes(data []byte) (b []byte, n int) {
+	if len(data) < 4 {
+		return nil, -1
+	}
+	length := binary.BigEndian.Uint32(data)
+	if uint64(len(data)-4) < uint64(length) {
+		return nil, -1
+	}
+	return append([]byte{}, data[4:4+length]...), 4 + int(length)
+}
+
+// Replay the segments left by the last run into the memtable and write
+// It to disk, the segments are deleted once it is. From then on the
+// Writes to memtable are logged to this wal
+func (w *wal) flushWAL(m *memtable) error {
+	var entries []walEntry
+	for _, filename := range w.recovered {
+		segment, err := m.recoverWAL(filename)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, segment...)
+	}
+	w.recovered = nil
+
+	if len(entries) == 0 {
+		m.logger.Println("WAL is empty.")
+		if err := w.removeSegments(w.number - 1); err != nil {
+			m.logger.Println("Error removing WAL segments:", err)
+		}
+	} else {
+		m.logger.Println("Reconstructing WAL entries...")
+		for _, record := range entries {
+			// Entries of an older wal are numbered in the order
+			// They were written
+			seq := record.Seq
+			if seq == 0 {
+				seq = m.nextSequence()
+			} else {
+				m.advanceSequence(seq)
+			}
+
+			if record.Action == 'S' {
+				m.data.Put(entry{Kind: kindSet, Seq: seq, Key: record.Key, Value: record.Value})
+			} else if record.Action == 'D' {
+				m.data.Put(entry{Kind: kindDelete, Seq: seq, Key: record.Key})
+			}
+		}
+
+		// The entries stay in the memtable, and their segments on
+		// Disk, when they cannot be written. The next flush of the
+		// Memtable writes them and removes the segments
+		if err := m.tables.writeSST(m.data); err != nil {
+			m.logger.Println("Error flushing memtable to new SST file:", err)
+		} else {
+			m.Clear()
+			if err := w.removeSegments(w.number - 1); err != nil {
+				m.logger.Println("Error removing WAL segments:", err)
+			}
+		}
+	}
+
+	if w.file == nil {
+		file, err := w.createSegment(w.number)
+		if err != nil {
+			return err
+		}
+		w.file = file
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.visibleSequence.Store(m.lastSequence.Load())
+	m.wal = w
+	return nil
+}
+
+// Read a wal to replay it. A torn or corrupt record ends the replay, the
+// Bytes from there are dropped unless strict recovery is asked for
+func (m *memtable) recoverWAL(filename string) ([]walEntry, error) {
+	entries, err := readWAL(filename)
+	var corruption *walCorruptionError
+	if errors.As(err, &corruption) {
+		if m.strictRecovery {
+			return nil, err
+		}
+		m.logger.Println("Recovering WAL:", err)
+		return entries, nil
+	}
+	return entries, err
+}
+
+// Start a new segment for the writes that follow a freeze, and return
+// The number of the segment holding the entries of the frozen memtable
+func (w *wal) rotate() (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	file, err := w.createSegment(w.number + 1)
+	if err != nil {
+		return 0, err
+	}
+
+	// The periodic sync only looks at the current segment
+	if w.syncMode == SyncPeriodic {
+		w.sync()
+	}
+	w.file.Close()
+	w.file = file
+	w.size = 0
+	w.number++
+	return w.number - 1, nil
+}
+
+// Remove the segments up to number once their memtables are recorded in
+// Sst files. A memtable holds the entries of every older segment that
+// Is still around, so they all go
+func (w *wal) removeSegments(number uint64) error {
+	names, err := os.ReadDir(w.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		segment, ok := parseWALSegmentName(name.Name())
+		if (ok && segment <= number) || name.Name() == legacyWALName {
+			if err := os.Remove(filepath.Join(w.dir, name.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (w *wal) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Nothing was written when the replay failed
+	if w.file == nil {
+		return nil
+	}
+
+	var err error
+	if w.syncMode != SyncNone {
+		err = w.sync()
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,276 @@
+package zikodb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Open the wal stored in dir and start a new segment after the existing
+// Ones right away, without replaying them
+func newWAL(dir string) (*wal, error) {
+	w, err := openWAL(dir)
+	if err != nil {
+		return nil, err
+	}
+	if w.file, err = w.createSegment(w.number); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func TestWALKeepsSequenceNumbers(t *testing.T) {
+	wal, err := newWAL(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	path := wal.file.Name()
+
+	// A record of a wal written before sequence numbers existed
+	binary.Write(wal.file, binary.BigEndian, byte('S'))
+	binary.Write(wal.file, binary.BigEndian, uint32(1))
+	wal.file.Write([]byte("a"))
+	binary.Write(wal.file, binary.BigEndian, uint32(1))
+	wal.file.Write([]byte("1"))
+
+	wal.Write(&walEntry{Action: 'S', Seq: 7, Key: []byte("b"), Value: []byte("2")})
+	wal.Write(&walEntry{Action: 'D', Seq: 8, Key: []byte("a")})
+
+	entries, err := readWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Read %d entries, expected 3", len(entries))
+	}
+	for i, expected := range []walEntry{{Action: 'S', Key: []byte("a")}, {Action: 'S', Seq: 7, Key: []byte("b")}, {Action: 'D', Seq: 8, Key: []byte("a")}} {
+		if entries[i].Action != expected.Action || entries[i].Seq != expected.Seq || string(entries[i].Key) != string(expected.Key) {
+			t.Errorf("Entry %d is %v, expected %v", i, entries[i], expected)
+		}
+	}
+}
+
+func TestReadWALStopsAtCorruptRecord(t *testing.T) {
+	valid := encodeWALRecord(&walEntry{Action: 'S', Seq: 1, Key: []byte("a"), Value: []byte("1")})
+
+	flipped := encodeWALRecord(&walEntry{Action: 'S', Seq: 2, Key: []byte("b"), Value: []byte("2")})
+	flipped[len(flipped)-1] ^= 0xff
+
+	// A length of 4GiB must not be allocated
+	hugeLength := append([]byte{walFramedRecord}, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 1, 2)
+
+	tests := map[string][]byte{
+		"torn record":        valid[:len(valid)-3],
+		"checksum mismatch":  flipped,
+		"huge length":        hugeLength,
+		"torn legacy record": {'S', 0xff, 0xff, 0xff, 0xff, 'a'},
+		"zeroed tail":        make([]byte, 16),
+	}
+	for name, tail := range tests {
+		path := filepath.Join(t.TempDir(), "wal")
+		data := append(append([]byte{}, valid...), tail...)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		entries, err := readWAL(path)
+		var corruption *walCorruptionError
+		if !errors.As(err, &corruption) || !errors.Is(err, ErrCorruptWAL) {
+			t.Errorf("%s: readWAL returned %v, expected a corruption error", name, err)
+			continue
+		}
+		if len(entries) != 1 || string(entries[0].Key) != "a" {
+			t.Errorf("%s: expected the record before the corruption, got %v", name, entries)
+		}
+		if corruption.Offset != int64(len(valid)) || corruption.Discarded != int64(len(tail)) {
+			t.Errorf("%s: corruption at %d with %d bytes discarded, expected %d and %d", name, corruption.Offset, corruption.Discarded, len(valid), len(tail))
+		}
+	}
+}
+
+func TestOpenWithCorruptWAL(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir, nil)
+	db.Put([]byte("a"), []byte("1"))
+	db.Put([]byte("b"), []byte("2"))
+	db.Close()
+
+	// Tear the last record
+	path := filepath.Join(dir, "wal", walSegmentName(1))
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Truncate(path, info.Size()-1)
+
+	if _, err := Open(dir, &Options{StrictWALRecovery: true}); !errors.Is(err, ErrCorruptWAL) {
+		t.Fatalf("Strict Open returned %v, expected ErrCorruptWAL", err)
+	}
+	if after, _ := os.Stat(path); after.Size() != info.Size()-1 {
+		t.Errorf("Strict Open should leave the wal untouched")
+	}
+	if names, _ := os.ReadDir(filepath.Join(dir, "wal")); len(names) != 1 {
+		t.Errorf("Strict Open should not start a new segment, found %d files", len(names))
+	}
+
+	db = openTestDB(t, dir, nil)
+	if value, err := db.Get([]byte("a")); err != nil || string(value) != "1" {
+		t.Errorf("Get(a) = %q %v", value, err)
+	}
+	if _, err := db.Get([]byte("b")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("The torn write of b should be dropped, got %v", err)
+	}
+}
+
+func TestWALGroupCommit(t *testing.T) {
+	wal, err := newWAL(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	path := wal.file.Name()
+	wal.syncMode = SyncAlways
+
+	// Hold the file so that the writers pile up behind a single commit
+	wal.mu.Lock()
+	var writers sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		writers.Add(1)
+		go func(i int) {
+			defer writers.Done()
+			if err := wal.Write(&walEntry{Action: 'S', Seq: uint64(i + 1), Key: []byte(fmt.Sprint(i))}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	for {
+		wal.queueMu.Lock()
+		queued := len(wal.queue)
+		wal.queueMu.Unlock()
+		if queued == 20 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	wal.mu.Unlock()
+	writers.Wait()
+
+	if wal.writes.Load() != 20 || wal.syncs.Load() != 1 {
+		t.Errorf("%d writes with %d syncs, expected 20 writes in one sync", wal.writes.Load(), wal.syncs.Load())
+	}
+	if entries, err := readWAL(path); err != nil || len(entries) != 20 {
+		t.Errorf("Read %d entries %v, expected 20", len(entries), err)
+	}
+}
+
+func TestPeriodicSync(t *testing.T) {
+	db := openTestDB(t, t.TempDir(), &Options{Sync: SyncPeriodic, SyncInterval: time.Millisecond})
+	db.Put([]byte("a"), []byte("1"))
+
+	deadline := time.Now().Add(time.Second)
+	for db.Stats().WAL.Syncs == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if stats := db.Stats().WAL; stats.Writes != 1 || stats.Syncs == 0 {
+		t.Errorf("WAL stats = %+v, expected the write to be synced in the background", stats)
+	}
+}
+
+func TestOpenReplaysSegmentsInOrder(t *testing.T) {
+	dir := t.TempDir()
+	walDir := filepath.Join(dir, "wal")
+	os.MkdirAll(walDir, 0755)
+
+	// Unsequenced records of the single file wal are numbered in the
+	// Order the files are replayed
+	legacyRecord := func(key, value string) []byte {
+		var record []byte
+		record = append(record, 'S')
+		record = binary.BigEndian.AppendUint32(record, uint32(len(key)))
+		record = append(record, key...)
+		record = binary.BigEndian.AppendUint32(record, uint32(len(value)))
+		return append(record, value...)
+	}
+	os.WriteFile(filepath.Join(walDir, "wal"), append(legacyRecord("a", "legacy"), legacyRecord("b", "legacy")...), 0644)
+
+	segment := func(entries ...walEntry) []byte {
+		var data []byte
+		for i := range entries {
+			data = append(data, encodeWALRecord(&entries[i])...)
+		}
+		return data
+	}
+	os.WriteFile(filepath.Join(walDir, walSegmentName(3)), segment(walEntry{Action: 'S', Seq: 10, Key: []byte("b"), Value: []byte("3")}), 0644)
+	os.WriteFile(filepath.Join(walDir, walSegmentName(5)), segment(walEntry{Action: 'S', Seq: 11, Key: []byte("c"), Value: []byte("5")}), 0644)
+
+	db := openTestDB(t, dir, nil)
+	for key, expected := range map[string]string{"a": "legacy", "b": "3", "c": "5"} {
+		if value, err := db.Get([]byte(key)); err != nil || string(value) != expected {
+			t.Errorf("Get(%s) = %q %v, expected %q", key, value, err, expected)
+		}
+	}
+
+	// The replayed entries are in an sst file, only the new segment is left
+	names, _ := os.ReadDir(walDir)
+	if len(names) != 1 || names[0].Name() != walSegmentName(6) {
+		t.Errorf("Expected only the segment %s to be left, got %v", walSegmentName(6), names)
+	}
+	if len(db.Stats().SSTFiles) != 1 {
+		t.Errorf("Expected the replayed entries to be written to one sst file")
+	}
+}
+
+// Bytes left by a failed commit are cut off, the records committed after
+// It are then replayed
+func TestWALRollsBackFailedCommit(t *testing.T) {
+	wal, err := newWAL(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	path := wal.file.Name()
+
+	wal.Write(&walEntry{Action: 'S', Seq: 1, Key: []byte("a")})
+	record := encodeWALRecord(&walEntry{Action: 'S', Seq: 2, Key: []byte("b")})
+	wal.file.Write(record[:len(record)/2])
+	wal.rollback(errors.New("no space left on device"))
+	wal.Write(&walEntry{Action: 'S', Seq: 3, Key: []byte("c")})
+
+	entries, err := readWAL(path)
+	if err != nil || len(entries) != 2 || string(entries[1].Key) != "c" {
+		t.Errorf("readWAL returned %v %v, expected a and c", entries, err)
+	}
+}
+
+// When the torn bytes cannot be cut off, no write succeeds anymore
+func TestWALFailsWhenRollbackFails(t *testing.T) {
+	wal, err := newWAL(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := wal.file.Name()
+	wal.Write(&walEntry{Action: 'S', Seq: 1, Key: []byte("a")})
+
+	// Neither written nor truncated through a read only file
+	file := wal.file
+	if wal.file, err = os.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	defer wal.Close()
+
+	for seq := uint64(2); seq <= 3; seq++ {
+		if err := wal.Write(&walEntry{Action: 'S', Seq: seq, Key: []byte("b")}); err == nil {
+			t.Errorf("Write %d on a failed wal succeeded", seq)
+		}
+	}
+	if wal.failed == nil {
+		t.Errorf("The wal should be failed once it cannot be cut back")
+	}
+}